@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"uploader/pkg/services"
+
+	"go.uber.org/zap"
+)
+
+var copyCommand = &command{
+	name:        "copy",
+	usage:       "[options] <remote_source> <remote_dest>",
+	description: "Copy a remote file or directory on the server",
+}
+
+func init() {
+	copyCommand.run = func(ctx context.Context, args []string) error {
+		return runCopy(ctx, copyCommand, false, args)
+	}
+}
+
+// runCopy copies, or moves when move is set, a remote entry through the
+// API. Directories are handled recursively and merged into existing ones.
+func runCopy(ctx context.Context, c *command, move bool, args []string) error {
+	flags := c.newFlagSet()
+	dryRun := flags.Bool("dry-run", false, "Print the planned actions without changing anything")
+	onConflict := addConflictFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("source and destination are required")
+	}
+
+	env, err := newEnvironment(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	copier := services.NewCopyService(env.fileService(), env.log, move, *onConflict)
+
+	actions, err := copier.Plan(flags.Arg(0), flags.Arg(1))
+	if err != nil {
+		env.log.Error("plan failed", zap.Error(err))
+		return err
+	}
+
+	if *dryRun {
+		copier.Report(os.Stdout, actions)
+		fmt.Printf("%d actions planned\n", len(actions))
+		return nil
+	}
+
+	return copier.Execute(actions)
+}
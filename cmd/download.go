@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"uploader/pkg/pb"
+	"uploader/pkg/services"
+
+	"go.uber.org/zap"
+)
+
+var downloadCommand = &command{
+	name:        "download",
+	usage:       "[options] <remote_path> <local_directory>",
+	description: "Download a remote file or directory to a local directory",
+}
+
+func init() {
+	downloadCommand.run = runDownload
+}
+
+func runDownload(ctx context.Context, args []string) error {
+	flags := downloadCommand.newFlagSet()
+	workers := flags.Int("workers", 0, "Number of current workers to use when downloading multi-parts")
+	transfers := flags.Int("transfers", 0, "Number of current files to download at once")
+	dryRun := flags.Bool("dry-run", false, "Perform a trial run with no changes made")
+	reports := addReportFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("remote path and local directory are required")
+	}
+
+	remotePath := services.CleanPath(flags.Arg(0))
+	localDir := flags.Arg(1)
+
+	var wg sync.WaitGroup
+	progress := pb.NewProgress(
+		&wg,
+		pb.OptionSetWriter(reports.progressWriter()),
+		pb.OptionSetThrottle(65*time.Millisecond),
+	)
+
+	env, err := newEnvironment(ctx, progress)
+	if err != nil {
+		return err
+	}
+	config := env.config
+	log := env.log
+
+	numTransfers := config.Transfers
+	if *transfers != 0 {
+		numTransfers = *transfers
+	}
+
+	numWorkers := config.Workers
+	if *workers != 0 {
+		numWorkers = *workers
+	}
+
+	cipher, err := env.newCipher()
+	if err != nil {
+		return err
+	}
+
+	reporter := reports.newReporter()
+
+	downloader := services.NewDownloadService(
+		env.http,
+		numWorkers,
+		numTransfers,
+		config.PartSizes().Stream(),
+		env.pacer,
+		env.ctx,
+		progress,
+		&wg,
+		log,
+		*dryRun,
+		reporter,
+		cipher,
+	)
+
+	info, err := downloader.Stat(remotePath)
+	if err != nil {
+		log.Error("get remote path info failed", zap.String("remotePath", remotePath), zap.Error(err))
+		return err
+	}
+
+	if !*dryRun {
+		if err := os.MkdirAll(localDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	stopProgress := startProgress(downloader.Progress, reporter)
+	defer stopProgress()
+	// transfers already started finish before the progress stops
+	defer downloader.Progress.Wait()
+
+	if info.Type == "folder" {
+		dirInfo, err := downloader.GetFilesInDirectoryInfo(remotePath)
+		if err != nil {
+			log.Error("get files in directory info failed", zap.Error(err))
+			return err
+		}
+		downloader.Progress.AddTransfer(dirInfo.TotalFiles, dirInfo.TotalSize)
+		err = downloader.DownloadFilesInDirectory(remotePath, localDir)
+		if err != nil {
+			log.Error("download files in directory failed", zap.Error(err))
+			return err
+		}
+	} else {
+		name, size, err := downloader.LocalName(*info)
+		if err != nil {
+			log.Error("decrypt remote file name failed", zap.String("remotePath", remotePath), zap.Error(err))
+			return err
+		}
+		downloader.Progress.AddTransfer(1, size)
+		err = downloader.DownloadFile(*info, remotePath, filepath.Join(localDir, name))
+		if err != nil {
+			log.Error("download failed", zap.Error(err))
+			return err
+		}
+	}
+	downloader.Progress.Wait()
+
+	if err := downloader.Err(); err != nil {
+		log.Error("downloads failed", zap.Error(err))
+		return err
+	}
+
+	log.Info("downloads complete!")
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+	"uploader/config"
+	"uploader/pkg/bwlimit"
+	"uploader/pkg/crypt"
+	"uploader/pkg/dircache"
+	"uploader/pkg/logger"
+	"uploader/pkg/pb"
+	"uploader/pkg/report"
+	"uploader/pkg/scheduler"
+	"uploader/pkg/services"
+	"uploader/pkg/types"
+	"uploader/pkg/utils"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/pacer"
+	"github.com/rclone/rclone/lib/rest"
+	"go.uber.org/zap"
+)
+
+func newPacer(ctx context.Context) *fs.Pacer {
+	return fs.NewPacer(ctx, pacer.NewDefault(pacer.MinSleep(400*time.Millisecond),
+		pacer.MaxSleep(5*time.Second), pacer.DecayConstant(2), pacer.AttackConstant(0)))
+}
+
+// configPath and profileName are set by the -config and -profile flags
+// every command accepts
+var configPath, profileName string
+
+// environment holds everything a command needs to talk to Teldrive
+type environment struct {
+	ctx     context.Context
+	config  *config.Config
+	log     *zap.Logger
+	http    *rest.Client
+	pacer   *fs.Pacer
+	session types.Session
+}
+
+// newEnvironment loads the config, sets up logging and checks the session.
+// When progress is set, debug logs are drawn above the progress bars,
+// otherwise they are written to stderr.
+func newEnvironment(ctx context.Context, progress *pb.Progress) (*environment, error) {
+	cfg, err := config.Load(configPath, profileName)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.GetConfig(context.TODO()).LogLevel = fs.LogLevelDebug
+	var log *zap.Logger
+	if cfg.Debug {
+		if progress != nil {
+			log = logger.InitLogger(logger.AddCustomWriter(progress.LogWriter))
+		} else {
+			log = logger.InitLogger(logger.AddCustomWriter(os.Stderr))
+		}
+	} else {
+		log = logger.InitLogger()
+	}
+	fs.LogPrint = func(level fs.LogLevel, text string) {
+		log.Debug(text)
+	}
+
+	authCookie := &http.Cookie{
+		Name:  services.SessionCookie,
+		Value: cfg.SessionToken,
+	}
+
+	httpClient := rest.NewClient(http.DefaultClient).SetRoot(cfg.ApiURL).SetCookie(authCookie)
+
+	pacer := newPacer(ctx)
+
+	session, err := services.NewAuthService(httpClient, pacer, ctx, log).Session()
+	if errors.Is(err, services.ErrSessionRejected) {
+		log.Error("session rejected", zap.Error(err))
+		return nil, fmt.Errorf("%w: %v", ErrAuth, err)
+	}
+	if err != nil {
+		log.Error("get session failed", zap.Error(err))
+		return nil, err
+	}
+	warnSessionExpiry(session)
+
+	return &environment{
+		ctx:     ctx,
+		config:  cfg,
+		log:     log,
+		http:    httpClient,
+		pacer:   pacer,
+		session: session,
+	}, nil
+}
+
+// sessionExpiryWarning is how long before the session expires login is suggested
+const sessionExpiryWarning = 72 * time.Hour
+
+// warnSessionExpiry tells the user to log in again when the session is about to expire
+func warnSessionExpiry(session types.Session) {
+	if session.Expires.IsZero() {
+		return
+	}
+	if left := time.Until(session.Expires); left < sessionExpiryWarning {
+		fmt.Fprintf(os.Stderr, "Warning: the session expires in %s, run '%s login' to renew it\n", left.Round(time.Minute), binaryName())
+	}
+}
+
+// newPartPacer returns the pacer used for part uploads. It is separate from
+// the API pacer so parts are not bound by its connection limit, and each
+// part is tried up to retries times with backoff.
+func (e *environment) newPartPacer(retries int) *fs.Pacer {
+	partPacer := newPacer(e.ctx)
+	partPacer.SetMaxConnections(0)
+	if retries < 1 {
+		retries = 1
+	}
+	partPacer.SetRetries(retries)
+	return partPacer
+}
+
+// startProgress draws progress until the returned function is called, which
+// then prints the final summary and hands the counters to reporter
+func startProgress(progress *pb.Progress, reporter *report.Reporter) func() {
+	stop := progress.StartProgress()
+	return func() {
+		stop()
+		fmt.Fprintln(os.Stderr, progress.Summary())
+		if err := reporter.Finish(progress.Stats()); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: write report failed:", err)
+		}
+	}
+}
+
+// newBandwidthLimiter returns the limiter for timetable, shown in the
+// progress header, or nil when no limit is set
+func newBandwidthLimiter(progress *pb.Progress, timetable fs.BwTimetable) *bwlimit.Limiter {
+	limiter := bwlimit.New(timetable)
+	if limiter != nil {
+		pb.OptionSetBandwidthLimit(limiter.String)(progress)
+	}
+	return limiter
+}
+
+// newPartScheduler returns the scheduler running up to workers part uploads
+// at once across all files, its queue shown in the progress header. With
+// AUTO_WORKERS the tuner returned moves the limit between WORKERS_MIN and
+// WORKERS_MAX until the command ends, otherwise it is nil.
+func (e *environment) newPartScheduler(progress *pb.Progress, workers int) (*scheduler.Scheduler, *scheduler.Tuner) {
+	parts := scheduler.New(workers)
+	if !e.config.AutoWorkers {
+		pb.OptionSetParts(parts.String)(progress)
+		return parts, nil
+	}
+
+	tuner := scheduler.NewTuner(parts, e.config.WorkersMin, e.config.WorkersMax, progress.Rate, e.log)
+	pb.OptionSetParts(func() string {
+		return parts.String() + ", " + tuner.String()
+	})(progress)
+	go tuner.Run(e.ctx)
+	return parts, tuner
+}
+
+// newCipher returns the client side encryption cipher, or nil when no
+// password is configured
+func (e *environment) newCipher() (*crypt.Cipher, error) {
+	if e.config.CryptPassword == "" {
+		return nil, nil
+	}
+	cipher, err := crypt.New(e.config.CryptPassword, e.config.CryptSalt, e.config.CryptFilenames)
+	if err != nil {
+		e.log.Error("init encryption failed", zap.Error(err))
+		return nil, err
+	}
+	return cipher, nil
+}
+
+// fileService returns a FileService for remote housekeeping commands
+func (e *environment) fileService() *services.FileService {
+	return services.NewFileService(e.http, e.pacer, e.ctx, e.log)
+}
+
+// remote returns the Teldrive server uploads are sent to
+func (e *environment) remote() services.Remote {
+	return services.NewRESTRemote(e.http, e.pacer, e.ctx, e.log)
+}
+
+// openDirCache returns the cache of remote folder ids, kept between runs in
+// uploader.dircache next to the executable when DIR_CACHE is set. The
+// returned function saves it.
+func (e *environment) openDirCache() (*dircache.Cache, func()) {
+	if !e.config.DirCache {
+		return nil, func() {}
+	}
+	owner := fmt.Sprintf("%s|%d", e.config.ApiURL, e.session.UserId)
+	cache, err := dircache.Open(filepath.Join(utils.ExecutableDir(), "uploader.dircache"), owner)
+	if err != nil {
+		e.log.Warn("open dir cache failed", zap.Error(err))
+		return nil, func() {}
+	}
+	e.log.Debug("loaded dir cache", zap.Int("dirs", cache.Len()))
+	return cache, func() {
+		if err := cache.Save(); err != nil {
+			e.log.Warn("save dir cache failed", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/rclone/rclone/fs/filter"
+)
+
+// stringList is a flag which may be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// filterFlags holds the rclone style include and exclude flags of a command
+type filterFlags struct {
+	opt        filter.Opt
+	include    stringList
+	exclude    stringList
+	filterFrom stringList
+}
+
+func addFilterFlags(flags *flag.FlagSet) *filterFlags {
+	f := &filterFlags{opt: filter.DefaultOpt}
+	flags.Var(&f.include, "include", "Include files matching this glob, may be repeated")
+	flags.Var(&f.exclude, "exclude", "Exclude files matching this glob, may be repeated")
+	flags.Var(&f.filterFrom, "filter-from", "Read include (+) and exclude (-) rules from this file, may be repeated")
+	flags.Var(&f.opt.MinSize, "min-size", "Only transfer files bigger than this, e.g. 100K or 1G")
+	flags.Var(&f.opt.MaxSize, "max-size", "Only transfer files smaller than this, e.g. 100K or 1G")
+	flags.Var(&f.opt.MinAge, "min-age", "Only transfer files older than this, e.g. 30m or 2d")
+	flags.Var(&f.opt.MaxAge, "max-age", "Only transfer files younger than this, e.g. 30m or 2d")
+	return f
+}
+
+// newFilter returns the filter built from the flags, or nil when no rule is set
+func (f *filterFlags) newFilter() (*filter.Filter, error) {
+	f.opt.IncludeRule = f.include
+	f.opt.ExcludeRule = f.exclude
+	f.opt.FilterFrom = f.filterFrom
+
+	fileFilter, err := filter.NewFilter(&f.opt)
+	if err != nil {
+		return nil, err
+	}
+	if fileFilter.InActive() {
+		return nil, nil
+	}
+	return fileFilter, nil
+}
@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"uploader/config"
+	"uploader/pkg/logger"
+	"uploader/pkg/services"
+
+	"github.com/rclone/rclone/lib/rest"
+	"golang.org/x/term"
+	"rsc.io/qr"
+)
+
+var loginCommand = &command{
+	name:        "login",
+	usage:       "[options]",
+	description: "Sign in to Teldrive and store the session token in the config file",
+}
+
+func init() {
+	loginCommand.run = runLogin
+}
+
+func runLogin(ctx context.Context, args []string) error {
+	flags := loginCommand.newFlagSet()
+	phone := flags.String("phone", "", "Sign in with a code sent to this phone number, in international format")
+	qrLogin := flags.Bool("qr", false, "Sign in by scanning a QR code with a signed in Telegram app")
+	token := flags.String("token", "", "Store this session token, e.g. the access_token cookie of the browser, instead of signing in")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return fmt.Errorf("login takes no arguments")
+	}
+
+	// reading the config sets the environment from the file
+	_, tokenInEnv := os.LookupEnv("SESSION_TOKEN")
+
+	// the session token is what login provides, so only API_URL must be set
+	cfg, err := config.Read(configPath, profileName)
+	if err != nil {
+		return err
+	}
+	if cfg.ApiURL == "" {
+		return fmt.Errorf("API_URL is not set in %s or the environment", cfg.Path)
+	}
+	log := logger.InitLogger()
+
+	stdin := bufio.NewReader(os.Stdin)
+
+	httpClient := rest.NewClient(http.DefaultClient).SetRoot(cfg.ApiURL)
+	auth := services.NewAuthService(httpClient, newPacer(ctx), ctx, log)
+
+	if *token != "" {
+		httpClient.SetCookie(&http.Cookie{Name: services.SessionCookie, Value: *token})
+	} else {
+		if *phone == "" && !*qrLogin {
+			*phone, err = prompt(stdin, "Phone number in international format, or empty to scan a QR code: ")
+			if err != nil {
+				return err
+			}
+		}
+		prompts := services.LoginPrompts{
+			Code: func() (string, error) {
+				return prompt(stdin, "Code sent by Telegram: ")
+			},
+			Password: func() (string, error) {
+				return promptPassword(stdin, "Two-step verification password: ")
+			},
+			QR: func(loginURL string) error {
+				fmt.Fprintln(os.Stderr, "Scan this code in Telegram under Settings > Devices > Link Desktop Device:")
+				return printQR(os.Stderr, loginURL)
+			},
+		}
+		*token, err = auth.Login(cfg.ApiURL, *phone, prompts)
+		if err != nil {
+			return err
+		}
+	}
+
+	session, err := auth.Session()
+	if errors.Is(err, services.ErrSessionRejected) {
+		return fmt.Errorf("%w: %v", ErrAuth, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := config.SetValue(cfg.Path, cfg.Profile, "SESSION_TOKEN", *token); err != nil {
+		return fmt.Errorf("store session token failed: %w", err)
+	}
+
+	fmt.Printf("Logged in as %s, session token stored in %s", session.UserName, cfg.Path)
+	if cfg.Profile != "" {
+		fmt.Printf(" for profile %s", cfg.Profile)
+	}
+	fmt.Println()
+	if !session.Expires.IsZero() {
+		fmt.Printf("The session expires on %s\n", session.Expires.Local().Format(time.DateTime))
+	}
+	if tokenInEnv {
+		fmt.Fprintln(os.Stderr, "Warning: SESSION_TOKEN is set in the environment and overrides the stored token")
+	}
+	return nil
+}
+
+// prompt asks for a line on stdin
+func prompt(stdin *bufio.Reader, question string) (string, error) {
+	fmt.Fprint(os.Stderr, question)
+	line, err := stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// promptPassword asks for a line on stdin without echoing it when stdin is a terminal
+func promptPassword(stdin *bufio.Reader, question string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return prompt(stdin, question)
+	}
+	fmt.Fprint(os.Stderr, question)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
+
+// printQR draws text as a QR code, two modules per character cell
+func printQR(w io.Writer, text string) error {
+	code, err := qr.Encode(text, qr.L)
+	if err != nil {
+		return err
+	}
+	// a light border of four modules lets phones find the code on dark terminals
+	const quiet = 4
+	black := func(x, y int) bool {
+		return code.Black(x-quiet, y-quiet)
+	}
+	size := code.Size + 2*quiet
+	var b strings.Builder
+	for y := 0; y < size; y += 2 {
+		for x := 0; x < size; x++ {
+			top, bottom := black(x, y), y+1 < size && black(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString(" ")
+			case top:
+				b.WriteString("▄")
+			case bottom:
+				b.WriteString("▀")
+			default:
+				b.WriteString("█")
+			}
+		}
+		b.WriteString("\n")
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
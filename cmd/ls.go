@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+	"uploader/pkg/services"
+)
+
+var lsCommand = &command{
+	name:        "ls",
+	usage:       "<remote_path>",
+	description: "List the contents of a remote directory",
+}
+
+func init() {
+	lsCommand.run = runLs
+}
+
+func runLs(ctx context.Context, args []string) error {
+	flags := lsCommand.newFlagSet()
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	remotePath := "/"
+	if flags.NArg() > 0 {
+		remotePath = flags.Arg(0)
+	}
+
+	env, err := newEnvironment(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	cipher, err := env.newCipher()
+	if err != nil {
+		return err
+	}
+
+	files, err := env.fileService().List(remotePath)
+	if err != nil {
+		return fmt.Errorf("list %s failed: %w", services.CleanPath(remotePath), err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for _, file := range files {
+		name, size := file.Name, file.Size
+		if file.Type == "folder" {
+			name += "/"
+		} else if cipher != nil {
+			// files which do not decrypt are listed as they are
+			decrypted, err := cipher.DecryptFileName(name)
+			decryptedSize, sizeErr := cipher.DecryptedSize(size)
+			if err == nil && sizeErr == nil {
+				name, size = decrypted, decryptedSize
+			}
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", size, file.ModTime.Local().Format(time.DateTime), name)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"uploader/pkg/services"
+)
+
+var mkdirCommand = &command{
+	name:        "mkdir",
+	usage:       "<remote_path>...",
+	description: "Create remote directories along with any missing parents",
+}
+
+func init() {
+	mkdirCommand.run = runMkdir
+}
+
+func runMkdir(ctx context.Context, args []string) error {
+	flags := mkdirCommand.newFlagSet()
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("remote path is required")
+	}
+
+	env, err := newEnvironment(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	files := env.fileService()
+	for _, remotePath := range flags.Args() {
+		if err := files.Mkdir(remotePath); err != nil {
+			return fmt.Errorf("mkdir %s failed: %w", services.CleanPath(remotePath), err)
+		}
+	}
+	return nil
+}
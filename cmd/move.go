@@ -0,0 +1,15 @@
+package cmd
+
+import "context"
+
+var moveCommand = &command{
+	name:        "move",
+	usage:       "[options] <remote_source> <remote_dest>",
+	description: "Move a remote file or directory, merging into existing directories",
+}
+
+func init() {
+	moveCommand.run = func(ctx context.Context, args []string) error {
+		return runCopy(ctx, moveCommand, true, args)
+	}
+}
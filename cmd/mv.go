@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"uploader/pkg/services"
+
+	"github.com/rclone/rclone/fs"
+	"go.uber.org/zap"
+)
+
+var mvCommand = &command{
+	name:        "mv",
+	usage:       "[options] <remote_source> <remote_dest>",
+	description: "Move or rename a remote file or directory",
+}
+
+func init() {
+	mvCommand.run = runMv
+}
+
+func runMv(ctx context.Context, args []string) error {
+	flags := mvCommand.newFlagSet()
+	dryRun := flags.Bool("dry-run", false, "Perform a trial run with no changes made")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("source and destination are required")
+	}
+
+	env, err := newEnvironment(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	cipher, err := env.newCipher()
+	if err != nil {
+		return err
+	}
+
+	files := env.fileService()
+
+	src := services.CleanPath(flags.Arg(0))
+	dst := services.CleanPath(flags.Arg(1))
+	if src == "/" {
+		return fmt.Errorf("refusing to move the root directory")
+	}
+
+	info, err := files.StatCrypt(src, cipher)
+	if err != nil {
+		return fmt.Errorf("stat %s failed: %w", src, err)
+	}
+
+	// moving onto an existing directory keeps the name, like mv(1)
+	destDir, destName := path.Dir(dst), path.Base(dst)
+	dstInfo, err := files.StatCrypt(dst, cipher)
+	switch {
+	case err == nil && dstInfo.Type == "folder":
+		destDir, destName = dst, path.Base(src)
+	case err == nil:
+		return fmt.Errorf("%s already exists", dst)
+	case !errors.Is(err, fs.ErrorObjectNotFound):
+		return fmt.Errorf("stat %s failed: %w", dst, err)
+	}
+
+	// a new file name is given as ls shows it, the remote one is encrypted
+	remoteName := info.Name
+	if destName != path.Base(src) {
+		remoteName = destName
+		if cipher != nil && info.Type != "folder" {
+			remoteName = cipher.EncryptFileName(destName)
+		}
+	}
+
+	if *dryRun {
+		fmt.Printf("would move %s to %s\n", src, path.Join(destDir, destName))
+		return nil
+	}
+
+	env.log.Info("moving", zap.String("src", src), zap.String("destDir", destDir), zap.String("destName", destName))
+
+	if path.Dir(src) != destDir {
+		if err := files.Move(destDir, info.Id); err != nil {
+			return fmt.Errorf("move %s failed: %w", src, err)
+		}
+	}
+
+	if info.Name != remoteName {
+		if err := files.Rename(info, remoteName); err != nil {
+			return fmt.Errorf("rename %s failed: %w", src, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+	"uploader/pkg/pb"
+	"uploader/pkg/services"
+
+	"github.com/rclone/rclone/fs"
+	"go.uber.org/zap"
+	"golang.org/x/term"
+)
+
+var rcatCommand = &command{
+	name:        "rcat",
+	usage:       "[options] <remote_path>",
+	description: "Upload standard input to a remote file",
+}
+
+func init() {
+	rcatCommand.run = runRcat
+}
+
+func runRcat(ctx context.Context, args []string) error {
+	flags := rcatCommand.newFlagSet()
+	workers := flags.Int("workers", 0, "Number of parts to read ahead and upload at once")
+	dryRun := flags.Bool("dry-run", false, "Perform a trial run with no changes made")
+	retries := flags.Int("retries", 0, "Number of times to try each part upload. Overrides PART_RETRIES")
+	var bwLimit fs.BwTimetable
+	flags.Var(&bwLimit, "bwlimit", "Bandwidth limit or timetable, e.g. 2M or \"08:00,2M 19:00,off\". Overrides BWLIMIT")
+	onConflict := services.ConflictSkip
+	flags.Var(&onConflict, "on-conflict", "What to do when the remote file exists: overwrite or rename, anything else fails")
+	reports := addReportFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("remote path is required")
+	}
+
+	remotePath := services.CleanPath(flags.Arg(0))
+	if remotePath == "/" {
+		return fmt.Errorf("remote path must name a file")
+	}
+
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("rcat uploads standard input, pipe the data into it")
+	}
+
+	var wg sync.WaitGroup
+	progress := pb.NewProgress(
+		&wg,
+		pb.OptionSetWriter(reports.progressWriter()),
+		pb.OptionSetThrottle(65*time.Millisecond),
+	)
+
+	env, err := newEnvironment(ctx, progress)
+	if err != nil {
+		return err
+	}
+	config := env.config
+	log := env.log
+
+	numWorkers := config.Workers
+	if *workers != 0 {
+		numWorkers = *workers
+	}
+
+	if len(bwLimit) == 0 {
+		bwLimit = config.BwLimit
+	}
+	bwLimiter := newBandwidthLimiter(progress, bwLimit)
+
+	partRetries := config.PartRetries
+	if *retries != 0 {
+		partRetries = *retries
+	}
+
+	cipher, err := env.newCipher()
+	if err != nil {
+		return err
+	}
+
+	reporter := reports.newReporter()
+
+	parts, tuner := env.newPartScheduler(progress, numWorkers)
+
+	uploader := services.NewUploadService(
+		env.remote(),
+		parts,
+		1,
+		config.PartSizes(),
+		config.EncryptFiles,
+		config.RandomisePart,
+		config.ChannelID,
+		false,
+		env.ctx,
+		progress,
+		&wg,
+		log,
+		env.session.UserId,
+		*dryRun,
+		nil,
+		nil,
+		bwLimiter,
+		env.newPartPacer(partRetries),
+		reporter,
+		cipher,
+		onConflict,
+		nil,
+		tuner,
+	)
+
+	destDir := path.Dir(remotePath)
+
+	if err := uploader.CreateRemoteDir(destDir); err != nil {
+		log.Error("create remote dir failed", zap.Error(err))
+		return err
+	}
+
+	stopProgress := startProgress(uploader.Progress, reporter)
+	defer stopProgress()
+
+	uploader.Progress.AddTransfer(1, 0)
+	if err := uploader.UploadStream(os.Stdin, path.Base(remotePath), destDir); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		log.Error("upload failed", zap.Error(err))
+		return err
+	}
+
+	log.Info("uploads complete!")
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"flag"
+	"io"
+	"os"
+	"uploader/pkg/report"
+)
+
+// reportFlags holds the machine readable output flags of the transfer commands
+type reportFlags struct {
+	json   bool
+	report string
+}
+
+func addReportFlags(flags *flag.FlagSet) *reportFlags {
+	f := &reportFlags{}
+	flags.BoolVar(&f.json, "json", false, "Print newline delimited JSON events on stdout instead of the progress display")
+	flags.StringVar(&f.report, "report", "", "Write a JSON report of every transfer to this file at exit")
+	return f
+}
+
+// progressWriter returns where the progress display is drawn, nowhere in JSON mode
+func (f *reportFlags) progressWriter() io.Writer {
+	if f.json {
+		return io.Discard
+	}
+	return os.Stderr
+}
+
+// newReporter returns the reporter for the flags, or nil when neither is set
+func (f *reportFlags) newReporter() *report.Reporter {
+	var events io.Writer
+	if f.json {
+		events = os.Stdout
+	}
+	return report.New(events, f.report)
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"uploader/pkg/services"
+
+	"go.uber.org/zap"
+)
+
+var rmCommand = &command{
+	name:        "rm",
+	usage:       "[options] <remote_path>...",
+	description: "Remove remote files, or directories with -r",
+}
+
+func init() {
+	rmCommand.run = runRm
+}
+
+func runRm(ctx context.Context, args []string) error {
+	flags := rmCommand.newFlagSet()
+	recursive := flags.Bool("r", false, "Remove directories and their contents")
+	dryRun := flags.Bool("dry-run", false, "Perform a trial run with no changes made")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("remote path is required")
+	}
+
+	env, err := newEnvironment(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	cipher, err := env.newCipher()
+	if err != nil {
+		return err
+	}
+
+	files := env.fileService()
+
+	var ids []string
+	for _, remotePath := range flags.Args() {
+		remotePath = services.CleanPath(remotePath)
+		if remotePath == "/" {
+			return fmt.Errorf("refusing to remove the root directory")
+		}
+
+		info, err := files.StatCrypt(remotePath, cipher)
+		if err != nil {
+			return fmt.Errorf("stat %s failed: %w", remotePath, err)
+		}
+		if info.Type == "folder" && !*recursive {
+			return fmt.Errorf("%s is a directory, use -r to remove it", remotePath)
+		}
+
+		if *dryRun {
+			fmt.Printf("would remove %s\n", remotePath)
+			continue
+		}
+		ids = append(ids, info.Id)
+		env.log.Info("removing", zap.String("path", remotePath), zap.String("id", info.Id))
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if err := files.Delete(ids...); err != nil {
+		return fmt.Errorf("remove failed: %w", err)
+	}
+	return nil
+}
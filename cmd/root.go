@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"uploader/pkg/services"
+)
+
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(ctx context.Context, args []string) error
+}
+
+func commands() []*command {
+	return []*command{
+		uploadCommand,
+		rcatCommand,
+		downloadCommand,
+		syncCommand,
+		watchCommand,
+		verifyCommand,
+		lsCommand,
+		mkdirCommand,
+		rmCommand,
+		mvCommand,
+		copyCommand,
+		moveCommand,
+		statCommand,
+		loginCommand,
+	}
+}
+
+func binaryName() string {
+	if runtime.GOOS == "windows" {
+		return "./uploader.exe"
+	}
+	return "./uploader"
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [options] [arguments]\n\nCommands:\n", binaryName())
+	for _, c := range commands() {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the options of a command.\n", binaryName())
+}
+
+// newFlagSet returns the flag set of c with a usage line matching the command tree
+func (c *command) newFlagSet() *flag.FlagSet {
+	flags := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	flags.StringVar(&configPath, "config", "", "Read settings from this file instead of upload.env next to the executable")
+	flags.StringVar(&profileName, "profile", "", "Use the settings of this profile of the config file")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s %s\n\n%s\n", binaryName(), c.name, c.usage, c.description)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// ErrCancelled is returned when the command was interrupted by a signal
+var ErrCancelled = errors.New("cancelled")
+
+// ErrAuth is returned when Teldrive rejects the session token
+var ErrAuth = errors.New("authentication failed")
+
+// Exit statuses, so scripts can tell failures apart
+const (
+	ExitOK             = 0
+	ExitFailure        = 1
+	ExitPartialFailure = 2
+	ExitAuthFailure    = 3
+	// ExitCancelled is the status after an interrupt, as a shell would report it
+	ExitCancelled = 130
+)
+
+// ExitCode returns the exit status for an error returned by Execute. Runs
+// in which only some transfers failed exit with ExitPartialFailure, any
+// other error with ExitFailure.
+func ExitCode(err error) int {
+	var transferErr *services.TransferError
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, ErrCancelled):
+		return ExitCancelled
+	case errors.Is(err, ErrAuth):
+		return ExitAuthFailure
+	case errors.As(err, &transferErr) && transferErr.Partial():
+		return ExitPartialFailure
+	default:
+		return ExitFailure
+	}
+}
+
+// Execute runs the command named by the first argument. Flags given without
+// a command are passed to upload, so "uploader -path ... -dest ..." keeps working.
+//
+// The first SIGINT or SIGTERM cancels the context given to the command so
+// in-flight requests abort and the command can report what it did, a second
+// one exits at once.
+func Execute(args []string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	go func() {
+		select {
+		case <-signals:
+		case <-ctx.Done():
+			return
+		}
+		fmt.Fprintln(os.Stderr, "\nCancelling, press Ctrl-C again to exit now")
+		cancel()
+		<-signals
+		fmt.Fprintln(os.Stderr, "\nExiting without cleanup")
+		os.Exit(ExitCancelled)
+	}()
+
+	err := execute(ctx, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ErrCancelled
+	}
+	return err
+}
+
+func execute(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		printUsage()
+		return nil
+	}
+
+	name := args[0]
+	if strings.HasPrefix(name, "-") && name != "-h" && name != "-help" && name != "--help" {
+		return uploadCommand.run(ctx, args)
+	}
+
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		printUsage()
+		return nil
+	}
+
+	for _, c := range commands() {
+		if c.name == name {
+			return c.run(ctx, args[1:])
+		}
+	}
+
+	printUsage()
+	return fmt.Errorf("unknown command %q", name)
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"uploader/pkg/services"
+)
+
+var statCommand = &command{
+	name:        "stat",
+	usage:       "<remote_path>",
+	description: "Show details of a remote file or directory",
+}
+
+func init() {
+	statCommand.run = runStat
+}
+
+func runStat(ctx context.Context, args []string) error {
+	flags := statCommand.newFlagSet()
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("a single remote path is required")
+	}
+
+	env, err := newEnvironment(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	cipher, err := env.newCipher()
+	if err != nil {
+		return err
+	}
+
+	remotePath := services.CleanPath(flags.Arg(0))
+	info, err := env.fileService().StatCrypt(remotePath, cipher)
+	if err != nil {
+		return fmt.Errorf("stat %s failed: %w", remotePath, err)
+	}
+
+	fmt.Printf("Path:     %s\n", remotePath)
+	fmt.Printf("ID:       %s\n", info.Id)
+	fmt.Printf("Type:     %s\n", info.Type)
+	if info.Type != "folder" {
+		fmt.Printf("Size:     %d\n", info.Size)
+		fmt.Printf("MimeType: %s\n", info.MimeType)
+	}
+	if !info.ModTime.IsZero() {
+		fmt.Printf("Modified: %s\n", info.ModTime.Local().Format(time.RFC3339))
+	}
+	return nil
+}
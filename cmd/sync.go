@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"uploader/pkg/pb"
+	"uploader/pkg/services"
+
+	"github.com/rclone/rclone/fs"
+	"go.uber.org/zap"
+)
+
+var syncCommand = &command{
+	name:        "sync",
+	usage:       "[options] <local_directory> <remote_directory>",
+	description: "Make a remote directory match a local directory, one way",
+}
+
+func init() {
+	syncCommand.run = runSync
+}
+
+func runSync(ctx context.Context, args []string) error {
+	flags := syncCommand.newFlagSet()
+	workers := flags.Int("workers", 0, "Number of parts uploaded at once across all files")
+	transfers := flags.Int("transfers", 0, "Number of current files to upload at once")
+	dryRun := flags.Bool("dry-run", false, "Report every planned action with no changes made")
+	deleteExtras := flags.Bool("delete", false, "Delete remote files which do not exist locally")
+	trashDir := flags.String("trash", "", "Move remote files which do not exist locally to this remote directory")
+	useChecksum := flags.Bool("checksum", false, "Compare files of the same size by their stored hash")
+	retries := flags.Int("retries", 0, "Number of times to try each part upload. Overrides PART_RETRIES")
+	var bwLimit fs.BwTimetable
+	flags.Var(&bwLimit, "bwlimit", "Bandwidth limit or timetable, e.g. 2M or \"08:00,2M 19:00,off\". Overrides BWLIMIT")
+	filters := addFilterFlags(flags)
+	reports := addReportFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	fileFilter, err := filters.newFilter()
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("local directory and remote directory are required")
+	}
+
+	if *deleteExtras && *trashDir != "" {
+		return fmt.Errorf("-delete and -trash cannot be used together")
+	}
+
+	sourcePath := flags.Arg(0)
+	destDir := services.CleanPath(flags.Arg(1))
+
+	fileInfo, err := os.Stat(sourcePath)
+	if err != nil {
+		return err
+	}
+	if !fileInfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", sourcePath)
+	}
+
+	var wg sync.WaitGroup
+	progress := pb.NewProgress(
+		&wg,
+		pb.OptionSetWriter(reports.progressWriter()),
+		pb.OptionSetThrottle(65*time.Millisecond),
+	)
+
+	env, err := newEnvironment(ctx, progress)
+	if err != nil {
+		return err
+	}
+	config := env.config
+	log := env.log
+
+	numTransfers := config.Transfers
+	if *transfers != 0 {
+		numTransfers = *transfers
+	}
+
+	numWorkers := config.Workers
+	if *workers != 0 {
+		numWorkers = *workers
+	}
+
+	if len(bwLimit) == 0 {
+		bwLimit = config.BwLimit
+	}
+	bwLimiter := newBandwidthLimiter(progress, bwLimit)
+
+	partRetries := config.PartRetries
+	if *retries != 0 {
+		partRetries = *retries
+	}
+
+	cipher, err := env.newCipher()
+	if err != nil {
+		return err
+	}
+
+	reporter := reports.newReporter()
+
+	dirCache, saveDirCache := env.openDirCache()
+	defer saveDirCache()
+
+	parts, tuner := env.newPartScheduler(progress, numWorkers)
+
+	uploader := services.NewUploadService(
+		env.remote(),
+		parts,
+		numTransfers,
+		config.PartSizes(),
+		config.EncryptFiles,
+		config.RandomisePart,
+		config.ChannelID,
+		// deleting local files after upload would make the next sync remove them remotely
+		false,
+		env.ctx,
+		progress,
+		&wg,
+		log,
+		env.session.UserId,
+		*dryRun,
+		nil,
+		fileFilter,
+		bwLimiter,
+		env.newPartPacer(partRetries),
+		reporter,
+		cipher,
+		services.ConflictSkip,
+		dirCache,
+		tuner,
+	)
+
+	syncer := services.NewSyncService(uploader, env.fileService(), *deleteExtras, *trashDir, *useChecksum)
+
+	actions, err := syncer.Plan(sourcePath, destDir)
+	if err != nil {
+		log.Error("plan sync failed", zap.Error(err))
+		return err
+	}
+
+	if *dryRun {
+		if reporter == nil {
+			syncer.Report(os.Stdout, actions)
+			fmt.Printf("%d actions planned\n", len(actions))
+			return nil
+		}
+		for _, action := range actions {
+			reporter.Planned(string(action.Op), action.LocalPath, action.RemotePath, action.Size, action.Reason)
+		}
+		return reporter.Finish(progress.Stats())
+	}
+
+	if err := uploader.CreateRemoteDir(destDir); err != nil {
+		log.Error("create remote dir failed", zap.Error(err))
+		return err
+	}
+
+	stopProgress := startProgress(uploader.Progress, reporter)
+	defer stopProgress()
+
+	if err := syncer.Execute(actions); err != nil {
+		log.Error("sync failed", zap.Error(err))
+		return err
+	}
+
+	log.Info("sync complete!", zap.Int("actions", len(actions)))
+
+	return nil
+}
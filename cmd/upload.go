@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"uploader/pkg/journal"
+	"uploader/pkg/pb"
+	"uploader/pkg/services"
+	"uploader/pkg/utils"
+
+	"github.com/rclone/rclone/fs"
+	"go.uber.org/zap"
+)
+
+var uploadCommand = &command{
+	name:        "upload",
+	usage:       "[options] <file_or_directory_path> <remote_directory>",
+	description: "Upload a local file or directory to a remote directory",
+}
+
+func init() {
+	uploadCommand.run = runUpload
+}
+
+func runUpload(ctx context.Context, args []string) error {
+	flags := uploadCommand.newFlagSet()
+	sourcePath := flags.String("path", "", "File or directory path to upload")
+	destDir := flags.String("dest", "", "Remote directory for uploaded files")
+	workers := flags.Int("workers", 0, "Number of parts uploaded at once across all files")
+	transfers := flags.Int("transfers", 0, "Number of current files to upload at once")
+	dryRun := flags.Bool("dry-run", false, "Perform a trial run with no changes made")
+	retries := flags.Int("retries", 0, "Number of times to try each part upload. Overrides PART_RETRIES")
+	var bwLimit fs.BwTimetable
+	flags.Var(&bwLimit, "bwlimit", "Bandwidth limit or timetable, e.g. 2M or \"08:00,2M 19:00,off\". Overrides BWLIMIT")
+	onConflict := addConflictFlag(flags)
+	filters := addFilterFlags(flags)
+	reports := addReportFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	fileFilter, err := filters.newFilter()
+	if err != nil {
+		return err
+	}
+
+	if *sourcePath == "" && flags.NArg() > 0 {
+		*sourcePath = flags.Arg(0)
+	}
+	if *destDir == "" && flags.NArg() > 1 {
+		*destDir = flags.Arg(1)
+	}
+
+	if *sourcePath == "" || *destDir == "" {
+		flags.Usage()
+		return fmt.Errorf("source path and remote directory are required")
+	}
+
+	var wg sync.WaitGroup
+	progress := pb.NewProgress(
+		&wg,
+		pb.OptionSetWriter(reports.progressWriter()),
+		pb.OptionSetThrottle(65*time.Millisecond),
+	)
+
+	env, err := newEnvironment(ctx, progress)
+	if err != nil {
+		return err
+	}
+	config := env.config
+	log := env.log
+
+	numTransfers := config.Transfers
+	if *transfers != 0 {
+		numTransfers = *transfers
+	}
+
+	numWorkers := config.Workers
+	if *workers != 0 {
+		numWorkers = *workers
+	}
+
+	if len(bwLimit) == 0 {
+		bwLimit = config.BwLimit
+	}
+	bwLimiter := newBandwidthLimiter(progress, bwLimit)
+
+	partRetries := config.PartRetries
+	if *retries != 0 {
+		partRetries = *retries
+	}
+
+	var uploadJournal *journal.Journal
+	if config.Journal && !*dryRun {
+		uploadJournal, err = journal.Open(filepath.Join(utils.ExecutableDir(), "uploader.journal"))
+		if err != nil {
+			log.Error("open journal failed", zap.Error(err))
+			return err
+		}
+		defer uploadJournal.Close()
+
+		for _, state := range uploadJournal.Interrupted() {
+			log.Info("resuming interrupted upload", zap.String("path", state.Path), zap.Int("uploadedParts", len(state.Parts)), zap.Time("lastUpdate", state.Updated))
+		}
+	}
+
+	cipher, err := env.newCipher()
+	if err != nil {
+		return err
+	}
+
+	reporter := reports.newReporter()
+
+	dirCache, saveDirCache := env.openDirCache()
+	defer saveDirCache()
+
+	parts, tuner := env.newPartScheduler(progress, numWorkers)
+
+	uploader := services.NewUploadService(
+		env.remote(),
+		parts,
+		numTransfers,
+		config.PartSizes(),
+		config.EncryptFiles,
+		config.RandomisePart,
+		config.ChannelID,
+		config.DeleteAfterUpload,
+		env.ctx,
+		progress,
+		&wg,
+		log,
+		env.session.UserId,
+		*dryRun,
+		uploadJournal,
+		fileFilter,
+		bwLimiter,
+		env.newPartPacer(partRetries),
+		reporter,
+		cipher,
+		*onConflict,
+		dirCache,
+		tuner,
+	)
+
+	path := services.CleanPath(*destDir)
+
+	err = uploader.CreateRemoteDir(path)
+	if err != nil {
+		log.Error("create remote dir failed", zap.Error(err))
+		return err
+	}
+
+	fileInfo, err := os.Stat(*sourcePath)
+	if err != nil {
+		log.Error("get sourcePath info failed", zap.Error(err))
+		return err
+	}
+
+	stopProgress := startProgress(uploader.Progress, reporter)
+	defer stopProgress()
+	// transfers already started finish before the progress stops
+	defer uploader.Progress.Wait()
+
+	if fileInfo.IsDir() {
+		info, err := uploader.GetFilesInDirectoryInfo(*sourcePath)
+		if err != nil {
+			log.Error("get files in directory info failed", zap.Error(err))
+			return err
+		}
+		uploader.Progress.AddTransfer(info.TotalFiles, info.TotalSize)
+		err = uploader.UploadFilesInDirectory(*sourcePath, path)
+		if err != nil {
+			log.Error("upload files in directory failed", zap.Error(err))
+			return err
+		}
+	} else {
+		uploader.Progress.AddTransfer(1, fileInfo.Size())
+		dirID, err := uploader.GetDirectoryId(path)
+		if err != nil {
+			log.Error("get directory id failed", zap.Error(err))
+			return err
+		}
+		// a failure is counted by the uploader and returned by Err below
+		if err := uploader.UploadFile(*sourcePath, path, dirID); err != nil {
+			log.Error("upload failed", zap.Error(err))
+		}
+	}
+	uploader.Progress.Wait()
+
+	if err := uploader.Err(); err != nil {
+		log.Error("uploads failed", zap.Error(err))
+		return err
+	}
+
+	log.Info("uploads complete!")
+
+	return nil
+}
+
+// addConflictFlag registers the -on-conflict flag choosing what happens to
+// files which already exist at the destination
+func addConflictFlag(flags *flag.FlagSet) *services.ConflictPolicy {
+	policy := services.ConflictSkip
+	flags.Var(&policy, "on-conflict", "What to do when the destination file exists: skip, overwrite, rename to \"name (1).ext\", or update when size or modtime differ")
+	return &policy
+}
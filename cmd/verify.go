@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"uploader/pkg/services"
+
+	"github.com/rclone/rclone/fs"
+)
+
+var verifyCommand = &command{
+	name:        "verify",
+	usage:       "<local_path> <remote_directory>",
+	description: "Check local files against the hashes stored with uploaded files",
+}
+
+func init() {
+	verifyCommand.run = runVerify
+}
+
+func runVerify(ctx context.Context, args []string) error {
+	flags := verifyCommand.newFlagSet()
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("local path and remote directory are required")
+	}
+
+	sourcePath := flags.Arg(0)
+	destDir := services.CleanPath(flags.Arg(1))
+
+	fileInfo, err := os.Stat(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	env, err := newEnvironment(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	cipher, err := env.newCipher()
+	if err != nil {
+		return err
+	}
+
+	files := env.fileService()
+	verifier := services.NewVerifyService(files, env.log, cipher)
+
+	counts := make(map[services.VerifyStatus]int)
+	var failed int
+	report := func(result services.VerifyResult) {
+		counts[result.Status]++
+		if result.Failed() {
+			failed++
+		}
+		if result.Err != nil {
+			fmt.Printf("%-12s %s: %v\n", result.Status, result.LocalPath, result.Err)
+		} else {
+			fmt.Printf("%-12s %s\n", result.Status, result.LocalPath)
+		}
+	}
+
+	if fileInfo.IsDir() {
+		if err := verifier.VerifyDirectory(sourcePath, destDir, report); err != nil {
+			return err
+		}
+	} else {
+		remotePath := path.Join(destDir, verifier.RemoteName(fileInfo.Name()))
+		remote, err := files.Stat(remotePath)
+		switch {
+		case errors.Is(err, fs.ErrorObjectNotFound):
+			report(services.VerifyResult{LocalPath: sourcePath, RemotePath: remotePath, Status: services.VerifyMissing})
+		case err != nil:
+			report(services.VerifyResult{LocalPath: sourcePath, RemotePath: remotePath, Status: services.VerifyError, Err: err})
+		default:
+			report(verifier.VerifyFile(sourcePath, remotePath, *remote))
+		}
+	}
+
+	fmt.Printf("\n%d ok, %d without hash, %d failed\n", counts[services.VerifyOK], counts[services.VerifyNoHash], failed)
+
+	if failed > 0 {
+		return fmt.Errorf("%d files failed verification", failed)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"uploader/pkg/journal"
+	"uploader/pkg/pb"
+	"uploader/pkg/services"
+	"uploader/pkg/utils"
+
+	"github.com/rclone/rclone/fs"
+	"go.uber.org/zap"
+)
+
+var watchCommand = &command{
+	name:        "watch",
+	usage:       "[options] <local_directory> <remote_directory>",
+	description: "Keep running and upload files as they appear in a local directory",
+}
+
+func init() {
+	watchCommand.run = runWatch
+}
+
+func runWatch(ctx context.Context, args []string) error {
+	flags := watchCommand.newFlagSet()
+	workers := flags.Int("workers", 0, "Number of parts uploaded at once across all files")
+	transfers := flags.Int("transfers", 0, "Number of current files to upload at once")
+	settle := flags.Duration("settle", 10*time.Second, "How long a file must stop growing before it is uploaded")
+	retries := flags.Int("retries", 0, "Number of times to try each part upload. Overrides PART_RETRIES")
+	var bwLimit fs.BwTimetable
+	flags.Var(&bwLimit, "bwlimit", "Bandwidth limit or timetable, e.g. 2M or \"08:00,2M 19:00,off\". Overrides BWLIMIT")
+	onConflict := addConflictFlag(flags)
+	filters := addFilterFlags(flags)
+	reports := addReportFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	fileFilter, err := filters.newFilter()
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("local directory and remote directory are required")
+	}
+
+	sourcePath := flags.Arg(0)
+	destDir := services.CleanPath(flags.Arg(1))
+
+	fileInfo, err := os.Stat(sourcePath)
+	if err != nil {
+		return err
+	}
+	if !fileInfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", sourcePath)
+	}
+
+	var wg sync.WaitGroup
+	progress := pb.NewProgress(
+		&wg,
+		pb.OptionSetWriter(reports.progressWriter()),
+		pb.OptionSetThrottle(65*time.Millisecond),
+	)
+
+	env, err := newEnvironment(ctx, progress)
+	if err != nil {
+		return err
+	}
+	config := env.config
+	log := env.log
+
+	numTransfers := config.Transfers
+	if *transfers != 0 {
+		numTransfers = *transfers
+	}
+
+	numWorkers := config.Workers
+	if *workers != 0 {
+		numWorkers = *workers
+	}
+
+	if len(bwLimit) == 0 {
+		bwLimit = config.BwLimit
+	}
+	bwLimiter := newBandwidthLimiter(progress, bwLimit)
+
+	partRetries := config.PartRetries
+	if *retries != 0 {
+		partRetries = *retries
+	}
+
+	var uploadJournal *journal.Journal
+	if config.Journal {
+		uploadJournal, err = journal.Open(filepath.Join(utils.ExecutableDir(), "uploader.journal"))
+		if err != nil {
+			log.Error("open journal failed", zap.Error(err))
+			return err
+		}
+		defer uploadJournal.Close()
+	}
+
+	cipher, err := env.newCipher()
+	if err != nil {
+		return err
+	}
+
+	reporter := reports.newReporter()
+
+	dirCache, saveDirCache := env.openDirCache()
+	defer saveDirCache()
+
+	parts, tuner := env.newPartScheduler(progress, numWorkers)
+
+	uploader := services.NewUploadService(
+		env.remote(),
+		parts,
+		numTransfers,
+		config.PartSizes(),
+		config.EncryptFiles,
+		config.RandomisePart,
+		config.ChannelID,
+		config.DeleteAfterUpload,
+		env.ctx,
+		progress,
+		&wg,
+		log,
+		env.session.UserId,
+		false,
+		uploadJournal,
+		fileFilter,
+		bwLimiter,
+		env.newPartPacer(partRetries),
+		reporter,
+		cipher,
+		*onConflict,
+		dirCache,
+		tuner,
+	)
+
+	if err := uploader.CreateRemoteDir(destDir); err != nil {
+		log.Error("create remote dir failed", zap.Error(err))
+		return err
+	}
+
+	stopProgress := startProgress(uploader.Progress, reporter)
+	defer stopProgress()
+	// transfers already started finish before the progress stops
+	defer uploader.Progress.Wait()
+
+	watcher := services.NewWatchService(uploader, *settle)
+	if err := watcher.Watch(sourcePath, destDir); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		log.Error("watch failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
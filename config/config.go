@@ -1,7 +1,16 @@
 package config
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"uploader/pkg/crypt"
+	"uploader/pkg/partsize"
 	"uploader/pkg/utils"
 
 	"github.com/joho/godotenv"
@@ -9,36 +18,352 @@ import (
 	"github.com/rclone/rclone/fs"
 )
 
+// DefaultFile is the config file looked up next to the executable
+const DefaultFile = "upload.env"
+
 type Config struct {
-	ApiURL            string        `envconfig:"API_URL" required:"true"`
-	SessionToken      string        `envconfig:"SESSION_TOKEN" required:"true"`
-	PartSize          fs.SizeSuffix `envconfig:"PART_SIZE"`
-	ChannelID         int64         `envconfig:"CHANNEL_ID"`
-	Workers           int           `envconfig:"WORKERS" default:"4"`
-	Transfers         int           `envconfig:"TRANSFERS" default:"4"`
-	RandomisePart     bool          `envconfig:"RANDOMISE_PART" default:"true"`
-	EncryptFiles      bool          `envconfig:"ENCRYPT_FILES" default:"false"`
-	DeleteAfterUpload bool          `envconfig:"DELETE_AFTER_UPLOAD" default:"false"`
-	Debug             bool          `envconfig:"DEBUG" default:"false"`
+	ApiURL            string         `envconfig:"API_URL"`
+	SessionToken      string         `envconfig:"SESSION_TOKEN"`
+	PartSize          partsize.Size  `envconfig:"PART_SIZE"`
+	PartSizeMin       fs.SizeSuffix  `envconfig:"PART_SIZE_MIN" default:"100M"`
+	PartSizeMax       fs.SizeSuffix  `envconfig:"PART_SIZE_MAX" default:"2000M"`
+	PartCount         int            `envconfig:"PART_COUNT" default:"100"`
+	ChannelID         int64          `envconfig:"CHANNEL_ID"`
+	Workers           int            `envconfig:"WORKERS" default:"4"`
+	Transfers         int            `envconfig:"TRANSFERS" default:"4"`
+	AutoWorkers       bool           `envconfig:"AUTO_WORKERS" default:"false"`
+	WorkersMin        int            `envconfig:"WORKERS_MIN" default:"1"`
+	WorkersMax        int            `envconfig:"WORKERS_MAX" default:"16"`
+	PartRetries       int            `envconfig:"PART_RETRIES" default:"5"`
+	RandomisePart     bool           `envconfig:"RANDOMISE_PART" default:"true"`
+	EncryptFiles      bool           `envconfig:"ENCRYPT_FILES" default:"false"`
+	CryptPassword     string         `envconfig:"CRYPT_PASSWORD"`
+	CryptSalt         string         `envconfig:"CRYPT_SALT"`
+	CryptFilenames    string         `envconfig:"CRYPT_FILENAME_ENCRYPTION" default:"standard"`
+	DeleteAfterUpload bool           `envconfig:"DELETE_AFTER_UPLOAD" default:"false"`
+	Journal           bool           `envconfig:"JOURNAL" default:"true"`
+	DirCache          bool           `envconfig:"DIR_CACHE" default:"false"`
+	BwLimit           fs.BwTimetable `envconfig:"BWLIMIT"`
+	Debug             bool           `envconfig:"DEBUG" default:"false"`
+
+	// Path and Profile record where the settings were read from
+	Path    string `ignored:"true"`
+	Profile string `ignored:"true"`
 }
 
 var config Config
 
-func InitConfig() {
+// File is a parsed config file. Settings before the first [name] section
+// are shared by every profile, each section holds the settings of the
+// profile of that name.
+type File struct {
+	Path     string
+	Shared   map[string]string
+	Profiles map[string]map[string]string
+}
 
-	root := utils.ExecutableDir()
-	envPath := filepath.Join(root, "upload.env")
-	err := godotenv.Load(envPath)
+// ReadFile parses the config file at path. Every section is read with the
+// same rules as a .env file, so a plain upload.env is a file without profiles.
+func ReadFile(path string) (*File, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	defer f.Close()
+
+	file := &File{Path: path, Profiles: make(map[string]map[string]string)}
+
+	var section string
+	sections := map[string]*strings.Builder{"": {}}
+	order := []string{""}
+	lineNo := 0
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			if !strings.HasSuffix(trimmed, "]") {
+				return nil, fmt.Errorf("%s:%d: unterminated section header %q", path, lineNo, trimmed)
+			}
+			section = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			if section == "" {
+				return nil, fmt.Errorf("%s:%d: empty profile name", path, lineNo)
+			}
+			if _, ok := sections[section]; !ok {
+				sections[section] = &strings.Builder{}
+				order = append(order, section)
+			}
+			continue
+		}
+		sections[section].WriteString(line)
+		sections[section].WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, name := range order {
+		values, err := godotenv.Unmarshal(sections[name].String())
+		if err != nil {
+			if name == "" {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			return nil, fmt.Errorf("%s: profile %q: %w", path, name, err)
+		}
+		if name == "" {
+			file.Shared = values
+		} else {
+			file.Profiles[name] = values
+		}
 	}
 
-	err = envconfig.Process("", &config)
+	return file, nil
+}
+
+// ProfileNames returns the names of the profiles of the file, sorted
+func (f *File) ProfileNames() []string {
+	names := make([]string, 0, len(f.Profiles))
+	for name := range f.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Settings returns the shared settings overlaid with those of profile, or
+// only the shared settings when profile is empty
+func (f *File) Settings(profile string) (map[string]string, error) {
+	values := make(map[string]string, len(f.Shared))
+	for key, value := range f.Shared {
+		values[key] = value
+	}
+	if profile == "" {
+		return values, nil
+	}
+	section, ok := f.Profiles[profile]
+	if !ok {
+		if len(f.Profiles) == 0 {
+			return nil, fmt.Errorf("profile %q not found, %s has no profiles", profile, f.Path)
+		}
+		return nil, fmt.Errorf("profile %q not found in %s, available: %s", profile, f.Path, strings.Join(f.ProfileNames(), ", "))
+	}
+	for key, value := range section {
+		values[key] = value
+	}
+	return values, nil
+}
+
+// DefaultPath returns the config file used when none is given, from
+// UPLOADER_CONFIG or else upload.env next to the executable
+func DefaultPath() string {
+	if path := os.Getenv("UPLOADER_CONFIG"); path != "" {
+		return path
+	}
+	return filepath.Join(utils.ExecutableDir(), DefaultFile)
+}
+
+// Load reads the settings of profile from the config file at path, using
+// DefaultPath when path is empty and UPLOADER_PROFILE when profile is.
+// Environment variables override the file. A missing default file is not
+// an error so every setting can come from the environment.
+func Load(path string, profile string) (*Config, error) {
+	cfg, err := Read(path, profile)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", describe(cfg.Path, cfg.Profile), err)
+	}
+	return cfg, nil
+}
+
+// Read is Load without the validation, for commands such as login which
+// run before the settings are complete
+func Read(path string, profile string) (*Config, error) {
+	explicit := path != "" || os.Getenv("UPLOADER_CONFIG") != ""
+	if path == "" {
+		path = DefaultPath()
+	}
+	if profile == "" {
+		profile = os.Getenv("UPLOADER_PROFILE")
+	}
+
+	file, err := ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && !explicit && profile == "":
+		file = &File{Path: path}
+	case err != nil:
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	values, err := file.Settings(profile)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range values {
+		if _, ok := os.LookupEnv(key); !ok {
+			os.Setenv(key, value)
+		}
+	}
+
+	var cfg Config
+	if err := envconfig.Process("", &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", describe(path, profile), err)
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = partsize.Size(partsize.Default)
+	}
+	cfg.Path, cfg.Profile = path, profile
+
+	config = cfg
+	return &config, nil
+}
+
+// SetValue sets key to value in the section of profile of the config file
+// at path, or among the shared settings when profile is empty. The file,
+// created when missing, is only readable by its owner as it holds secrets.
+func SetValue(path string, profile string, key string, value string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	setting := fmt.Sprintf("%s=%q", key, value)
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	// find the lines of the section, the shared settings end at the first header
+	start, end := 0, len(lines)
+	if profile != "" {
+		start = -1
+	}
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "[") || !strings.HasSuffix(trimmed, "]") {
+			continue
+		}
+		name := strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+		if start >= 0 {
+			end = i
+			break
+		}
+		if name == profile {
+			start = i + 1
+		}
+	}
+
+	switch {
+	case start < 0:
+		if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "["+profile+"]", setting)
+	default:
+		replaced := false
+		for i := start; i < end; i++ {
+			trimmed := strings.TrimPrefix(strings.TrimSpace(lines[i]), "export ")
+			if strings.HasPrefix(trimmed, key+"=") || strings.HasPrefix(trimmed, key+" =") {
+				lines[i] = setting
+				replaced = true
+			}
+		}
+		if !replaced {
+			// keep blank lines before the next section header
+			at := end
+			for at > start && strings.TrimSpace(lines[at-1]) == "" {
+				at--
+			}
+			lines = append(lines[:at], append([]string{setting}, lines[at:]...)...)
+		}
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// describe names the source of the settings in errors
+func describe(path string, profile string) string {
+	if profile == "" {
+		return "invalid config " + path
+	}
+	return fmt.Sprintf("invalid config %s, profile %q", path, profile)
+}
+
+// Validate checks the settings for values the commands cannot work with
+func (c *Config) Validate() error {
+	var problems []string
+	if c.ApiURL == "" {
+		problems = append(problems, "API_URL is not set")
+	} else if u, err := url.Parse(c.ApiURL); err != nil || u.Scheme == "" || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("API_URL %q is not an absolute URL", c.ApiURL))
+	}
+	if c.SessionToken == "" {
+		problems = append(problems, "SESSION_TOKEN is not set")
+	}
+	if c.PartSize != partsize.Auto {
+		if fs.SizeSuffix(c.PartSize) > partsize.MaxPart {
+			problems = append(problems, fmt.Sprintf("PART_SIZE %v is larger than the %v Telegram accepts", c.PartSize, partsize.MaxPart))
+		}
+	} else {
+		if c.PartSizeMin < 1 {
+			problems = append(problems, fmt.Sprintf("PART_SIZE_MIN must be positive, got %v", c.PartSizeMin))
+		}
+		if c.PartSizeMax > partsize.MaxPart {
+			problems = append(problems, fmt.Sprintf("PART_SIZE_MAX %v is larger than the %v Telegram accepts", c.PartSizeMax, partsize.MaxPart))
+		}
+		if c.PartSizeMin > c.PartSizeMax {
+			problems = append(problems, fmt.Sprintf("PART_SIZE_MIN %v is larger than PART_SIZE_MAX %v", c.PartSizeMin, c.PartSizeMax))
+		}
+		if c.PartCount < 1 {
+			problems = append(problems, fmt.Sprintf("PART_COUNT must be at least 1, got %d", c.PartCount))
+		}
+	}
+	if c.Workers < 1 {
+		problems = append(problems, fmt.Sprintf("WORKERS must be at least 1, got %d", c.Workers))
+	}
+	if c.AutoWorkers {
+		if c.WorkersMin < 1 {
+			problems = append(problems, fmt.Sprintf("WORKERS_MIN must be at least 1, got %d", c.WorkersMin))
+		}
+		if c.WorkersMax < c.WorkersMin {
+			problems = append(problems, fmt.Sprintf("WORKERS_MAX %d is less than WORKERS_MIN %d", c.WorkersMax, c.WorkersMin))
+		}
+	}
+	if c.Transfers < 1 {
+		problems = append(problems, fmt.Sprintf("TRANSFERS must be at least 1, got %d", c.Transfers))
+	}
+	if c.PartRetries < 0 {
+		problems = append(problems, fmt.Sprintf("PART_RETRIES must not be negative, got %d", c.PartRetries))
+	}
+	if c.CryptFilenames != crypt.NameEncryptionStandard && c.CryptFilenames != crypt.NameEncryptionOff {
+		problems = append(problems, fmt.Sprintf("CRYPT_FILENAME_ENCRYPTION must be standard or off, got %q", c.CryptFilenames))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// PartSizes returns the policy picking the part size of each file
+func (c *Config) PartSizes() partsize.Policy {
+	if c.PartSize != partsize.Auto {
+		return partsize.Policy{Fixed: int64(c.PartSize)}
 	}
-	if config.PartSize == 0 {
-		config.PartSize = 1000 * fs.Mebi
+	return partsize.Policy{
+		Min:    int64(c.PartSizeMin),
+		Max:    int64(c.PartSizeMax),
+		Target: c.PartCount,
 	}
 }
 
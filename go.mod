@@ -3,16 +3,21 @@ module uploader
 go 1.21
 
 require (
+	github.com/coder/websocket v1.8.12
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/gofrs/uuid v4.4.0+incompatible
 	github.com/mattn/go-colorable v0.1.13
+	github.com/rfjakob/eme v1.1.2
 	go.uber.org/zap v1.26.0
-	golang.org/x/sync v0.1.0
+	golang.org/x/crypto v0.17.0
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
+	rsc.io/qr v0.2.0
 )
 
 require (
 	github.com/mattn/go-isatty v0.0.19 // indirect
 	go.uber.org/multierr v1.10.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
 )
 
 require (
@@ -21,7 +26,7 @@ require (
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db
 	github.com/sirupsen/logrus v1.9.0 // indirect
 	golang.org/x/term v0.15.0
-	golang.org/x/time v0.3.0 // indirect
+	golang.org/x/time v0.3.0
 )
 
 require (
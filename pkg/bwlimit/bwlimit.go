@@ -0,0 +1,123 @@
+package bwlimit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"golang.org/x/time/rate"
+)
+
+// minBurst keeps the bucket big enough for a single read at low limits
+const minBurst = 64 * 1024
+
+// refreshInterval is how often the timetable is checked for a new slot
+const refreshInterval = time.Second
+
+// Limiter is a token bucket shared by every reader it wraps, following an
+// rclone style timetable such as "08:00,2M 19:00,off"
+type Limiter struct {
+	mu          sync.Mutex
+	timetable   fs.BwTimetable
+	limiter     *rate.Limiter
+	current     fs.SizeSuffix
+	lastRefresh time.Time
+}
+
+// New returns a Limiter for timetable, or nil when the timetable is empty
+func New(timetable fs.BwTimetable) *Limiter {
+	if len(timetable) == 0 {
+		return nil
+	}
+	l := &Limiter{
+		timetable: timetable,
+		limiter:   rate.NewLimiter(rate.Inf, minBurst),
+		current:   -1,
+	}
+	l.refresh(time.Now())
+	return l
+}
+
+// refresh applies the timetable slot active at now. Must be called with the lock held.
+func (l *Limiter) refresh(now time.Time) {
+	l.lastRefresh = now
+	limit := l.timetable.LimitAt(now).Bandwidth.Tx
+	if limit == l.current {
+		return
+	}
+	l.current = limit
+	if limit <= 0 {
+		l.limiter.SetLimitAt(now, rate.Inf)
+		return
+	}
+	burst := int(limit)
+	if burst < minBurst {
+		burst = minBurst
+	}
+	l.limiter.SetBurstAt(now, burst)
+	l.limiter.SetLimitAt(now, rate.Limit(limit))
+}
+
+// wait blocks until n bytes may be sent
+func (l *Limiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if now := time.Now(); now.Sub(l.lastRefresh) >= refreshInterval {
+		l.refresh(now)
+	}
+	limiter := l.limiter
+	l.mu.Unlock()
+
+	if limiter.Limit() == rate.Inf {
+		return nil
+	}
+	for n > 0 {
+		chunk := n
+		if burst := limiter.Burst(); chunk > burst {
+			chunk = burst
+		}
+		if err := limiter.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// String returns the limit currently applied, e.g. "2Mi/s" or "off"
+func (l *Limiter) String() string {
+	if l == nil {
+		return "off"
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.current <= 0 {
+		return "off"
+	}
+	return l.current.String() + "/s"
+}
+
+type reader struct {
+	io.Reader
+	ctx     context.Context
+	limiter *Limiter
+}
+
+func (r *reader) Read(b []byte) (n int, err error) {
+	n, err = r.Reader.Read(b)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// Reader returns r limited by l. A nil Limiter returns r unchanged.
+func (l *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{Reader: r, ctx: ctx, limiter: l}
+}
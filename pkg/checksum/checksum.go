@@ -0,0 +1,117 @@
+package checksum
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Algorithm prefixes every file hash so other schemes can be added later
+const Algorithm = "sha256"
+
+var ErrInvalidHash = errors.New("invalid file hash")
+
+// NewPart returns the hash used for a single part
+func NewPart() hash.Hash {
+	return sha256.New()
+}
+
+// FileHash combines the part hashes of a file. Parts are hashed
+// concurrently, so the file hash is the SHA-256 of the part digests in part
+// order rather than of the content itself.
+type FileHash struct {
+	PartSize int64
+	Parts    map[int][]byte
+}
+
+func NewFileHash(partSize int64) *FileHash {
+	return &FileHash{PartSize: partSize, Parts: make(map[int][]byte)}
+}
+
+// Add records the digest of part partNo, counted from 1
+func (f *FileHash) Add(partNo int, digest []byte) {
+	f.Parts[partNo] = digest
+}
+
+// String returns the file hash as "sha256:<part size>:<hex digest>"
+func (f *FileHash) String() string {
+	h := sha256.New()
+	for partNo := 1; partNo <= len(f.Parts); partNo++ {
+		h.Write(f.Parts[partNo])
+	}
+	return fmt.Sprintf("%s:%d:%s", Algorithm, f.PartSize, hex.EncodeToString(h.Sum(nil)))
+}
+
+// PartSize returns the part size a file hash was computed with
+func PartSize(fileHash string) (int64, error) {
+	fields := strings.Split(fileHash, ":")
+	if len(fields) != 3 || fields[0] != Algorithm {
+		return 0, ErrInvalidHash
+	}
+	partSize, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || partSize <= 0 {
+		return 0, ErrInvalidHash
+	}
+	return partSize, nil
+}
+
+// Range returns the hash of size bytes of r
+func Range(r io.Reader, size int64) ([]byte, error) {
+	h := NewPart()
+	n, err := io.Copy(h, io.LimitReader(r, size))
+	if err != nil {
+		return nil, err
+	}
+	if n != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return h.Sum(nil), nil
+}
+
+// File returns the file hash of the local file at path split in partSize parts
+func File(path string, partSize int64) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	fileHash := NewFileHash(partSize)
+	for partNo, start := 1, int64(0); start < info.Size(); partNo, start = partNo+1, start+partSize {
+		size := partSize
+		if start+size > info.Size() {
+			size = info.Size() - start
+		}
+		digest, err := Range(file, size)
+		if err != nil {
+			return "", err
+		}
+		fileHash.Add(partNo, digest)
+	}
+
+	return fileHash.String(), nil
+}
+
+// Verify reports whether the local file at path matches fileHash
+func Verify(path string, fileHash string) (bool, error) {
+	partSize, err := PartSize(fileHash)
+	if err != nil {
+		return false, err
+	}
+	localHash, err := File(path, partSize)
+	if err != nil {
+		return false, err
+	}
+	return localHash == fileHash, nil
+}
@@ -0,0 +1,440 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	gocipher "crypto/cipher"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rfjakob/eme"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The data format is the one of rclone's crypt backend: a header made of a
+// magic string and a random nonce, followed by 64 KiB blocks sealed with
+// NaCl secretbox, the nonce being incremented for every block. Blocks are
+// independent, so any byte range of the encrypted file can be produced or
+// decrypted on its own and parts can still be sent concurrently.
+const (
+	fileMagic       = "RCLONE\x00\x00"
+	fileNonceSize   = 24
+	fileHeaderSize  = len(fileMagic) + fileNonceSize
+	blockHeaderSize = secretbox.Overhead
+	blockDataSize   = 64 * 1024
+	blockSize       = blockHeaderSize + blockDataSize
+
+	nameCipherBlockSize = aes.BlockSize
+)
+
+// File name encryption modes
+const (
+	NameEncryptionStandard = "standard"
+	NameEncryptionOff      = "off"
+)
+
+// defaultSalt is the salt rclone uses when no second password is set
+var defaultSalt = []byte{0xA8, 0x0D, 0xF4, 0x3A, 0x8F, 0xBD, 0x03, 0x08, 0xA7, 0xCA, 0xB8, 0x3E, 0x58, 0x1F, 0x86, 0xB1}
+
+var (
+	ErrBadMagic     = errors.New("not an encrypted file, bad magic string")
+	ErrBadBlock     = errors.New("failed to authenticate decrypted block, bad password or corrupted file")
+	ErrEncryptedBad = errors.New("encrypted file has bad size")
+	ErrBadName      = errors.New("not an encrypted file name")
+)
+
+// Nonce is the random nonce stored in the header of every encrypted file
+type Nonce [fileNonceSize]byte
+
+// NewNonce returns a random nonce for a new encrypted file
+func NewNonce() (Nonce, error) {
+	var n Nonce
+	_, err := io.ReadFull(rand.Reader, n[:])
+	return n, err
+}
+
+// ParseNonce parses a nonce returned by Nonce.String
+func ParseNonce(s string) (Nonce, error) {
+	var n Nonce
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != fileNonceSize {
+		return n, fmt.Errorf("invalid nonce %q", s)
+	}
+	copy(n[:], b)
+	return n, nil
+}
+
+func (n Nonce) String() string {
+	return hex.EncodeToString(n[:])
+}
+
+// add returns the nonce of block x, as rclone increments it little endian
+// over the whole 24 bytes
+func (n Nonce) add(x uint64) *[fileNonceSize]byte {
+	carry := uint16(0)
+	for i := 0; i < 8; i++ {
+		carry += uint16(n[i]) + uint16(byte(x))
+		x >>= 8
+		n[i] = byte(carry)
+		carry >>= 8
+	}
+	for i := 8; carry != 0 && i < len(n); i++ {
+		n[i]++
+		if n[i] != 0 {
+			break
+		}
+	}
+	return (*[fileNonceSize]byte)(&n)
+}
+
+// Cipher encrypts file names and contents with keys derived from a passphrase
+type Cipher struct {
+	dataKey        [32]byte
+	nameKey        [32]byte
+	nameTweak      [nameCipherBlockSize]byte
+	nameBlock      gocipher.Block
+	nameEncryption string
+}
+
+// New returns a Cipher for password and the optional salt, rclone's
+// password2. nameEncryption is "standard" or "off" and only applies to file
+// names, directory names are kept readable.
+func New(password string, salt string, nameEncryption string) (*Cipher, error) {
+	if password == "" {
+		return nil, errors.New("encryption password not set")
+	}
+	if nameEncryption != NameEncryptionStandard && nameEncryption != NameEncryptionOff {
+		return nil, fmt.Errorf("unknown file name encryption %q", nameEncryption)
+	}
+
+	// the same key derivation as rclone, so its crypt backend can read the files
+	saltBytes := defaultSalt
+	if salt != "" {
+		saltBytes = []byte(salt)
+	}
+	c := &Cipher{nameEncryption: nameEncryption}
+	key, err := scrypt.Key([]byte(password), saltBytes, 16384, 8, 1, len(c.dataKey)+len(c.nameKey)+len(c.nameTweak))
+	if err != nil {
+		return nil, err
+	}
+	copy(c.dataKey[:], key)
+	copy(c.nameKey[:], key[len(c.dataKey):])
+	copy(c.nameTweak[:], key[len(c.dataKey)+len(c.nameKey):])
+
+	c.nameBlock, err = aes.NewCipher(c.nameKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// EncryptFileName returns the name stored remotely for name
+func (c *Cipher) EncryptFileName(name string) string {
+	if c.nameEncryption == NameEncryptionOff || name == "" {
+		return name
+	}
+	padded := pkcs7Pad([]byte(name))
+	ciphertext := eme.Transform(c.nameBlock, c.nameTweak[:], padded, eme.DirectionEncrypt)
+	return strings.ToLower(strings.TrimRight(base32.HexEncoding.EncodeToString(ciphertext), "="))
+}
+
+// DecryptFileName returns the original name of a stored file name
+func (c *Cipher) DecryptFileName(name string) (string, error) {
+	if c.nameEncryption == NameEncryptionOff || name == "" {
+		return name, nil
+	}
+	if padding := len(name) % 8; padding != 0 {
+		name += strings.Repeat("=", 8-padding)
+	}
+	ciphertext, err := base32.HexEncoding.DecodeString(strings.ToUpper(name))
+	if err != nil {
+		return "", ErrBadName
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%nameCipherBlockSize != 0 {
+		return "", ErrBadName
+	}
+	padded := eme.Transform(c.nameBlock, c.nameTweak[:], ciphertext, eme.DirectionDecrypt)
+	plaintext, err := pkcs7Unpad(padded)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// pkcs7Pad pads b to a whole number of name cipher blocks
+func pkcs7Pad(b []byte) []byte {
+	n := nameCipherBlockSize - len(b)%nameCipherBlockSize
+	return append(b, bytes.Repeat([]byte{byte(n)}, n)...)
+}
+
+func pkcs7Unpad(b []byte) ([]byte, error) {
+	if len(b) == 0 || len(b)%nameCipherBlockSize != 0 {
+		return nil, ErrBadName
+	}
+	n := int(b[len(b)-1])
+	if n == 0 || n > nameCipherBlockSize {
+		return nil, ErrBadName
+	}
+	for _, pad := range b[len(b)-n:] {
+		if int(pad) != n {
+			return nil, ErrBadName
+		}
+	}
+	return b[:len(b)-n], nil
+}
+
+// EncryptedSize returns the size of a file of size bytes once encrypted
+func (c *Cipher) EncryptedSize(size int64) int64 {
+	blocks, residue := size/blockDataSize, size%blockDataSize
+	encryptedSize := int64(fileHeaderSize) + blocks*blockSize
+	if residue != 0 {
+		encryptedSize += blockHeaderSize + residue
+	}
+	return encryptedSize
+}
+
+// DecryptedSize returns the original size of an encrypted file of size bytes
+func (c *Cipher) DecryptedSize(size int64) (int64, error) {
+	size -= int64(fileHeaderSize)
+	if size < 0 {
+		return 0, ErrEncryptedBad
+	}
+	blocks, residue := size/blockSize, size%blockSize
+	decryptedSize := blocks * blockDataSize
+	if residue != 0 {
+		residue -= blockHeaderSize
+		if residue <= 0 {
+			return 0, ErrEncryptedBad
+		}
+		decryptedSize += residue
+	}
+	return decryptedSize, nil
+}
+
+// ReadNonce reads the header at the start of an encrypted file
+func ReadNonce(r io.Reader) (Nonce, error) {
+	var n Nonce
+	header := make([]byte, fileHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return n, err
+	}
+	if string(header[:len(fileMagic)]) != fileMagic {
+		return n, ErrBadMagic
+	}
+	copy(n[:], header[len(fileMagic):])
+	return n, nil
+}
+
+// HeaderSize is the number of bytes to read for ReadNonce
+func HeaderSize() int64 {
+	return int64(fileHeaderSize)
+}
+
+type encrypter struct {
+	cipher *Cipher
+	src    io.ReaderAt
+	size   int64
+	nonce  Nonce
+	pos    int64
+	end    int64
+
+	block    int64
+	sealed   []byte
+	plainBuf []byte
+}
+
+// EncryptRange returns the bytes [offset, offset+length) of the encrypted
+// form of the size bytes of src, whose header holds nonce
+func (c *Cipher) EncryptRange(src io.ReaderAt, size int64, nonce Nonce, offset int64, length int64) io.Reader {
+	return &encrypter{
+		cipher:   c,
+		src:      src,
+		size:     size,
+		nonce:    nonce,
+		pos:      offset,
+		end:      offset + length,
+		block:    -1,
+		plainBuf: make([]byte, blockDataSize),
+	}
+}
+
+func (e *encrypter) Read(p []byte) (int, error) {
+	if e.pos >= e.end {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.end-e.pos {
+		p = p[:e.end-e.pos]
+	}
+
+	if e.pos < int64(fileHeaderSize) {
+		header := append([]byte(fileMagic), e.nonce[:]...)
+		n := copy(p, header[e.pos:])
+		e.pos += int64(n)
+		return n, nil
+	}
+
+	block, within := (e.pos-int64(fileHeaderSize))/blockSize, (e.pos-int64(fileHeaderSize))%blockSize
+	if block != e.block {
+		start := block * blockDataSize
+		plainSize := e.size - start
+		if plainSize <= 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if plainSize > blockDataSize {
+			plainSize = blockDataSize
+		}
+		plain := e.plainBuf[:plainSize]
+		if n, err := e.src.ReadAt(plain, start); n < len(plain) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		e.sealed = secretbox.Seal(e.sealed[:0], plain, e.nonce.add(uint64(block)), &e.cipher.dataKey)
+		e.block = block
+	}
+	if within >= int64(len(e.sealed)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	n := copy(p, e.sealed[within:])
+	e.pos += int64(n)
+	return n, nil
+}
+
+// CipherRange returns the range of an encrypted file of encryptedSize
+// bytes holding the original bytes [offset, offset+length)
+func (c *Cipher) CipherRange(offset int64, length int64, encryptedSize int64) (int64, int64) {
+	firstBlock := offset / blockDataSize
+	lastBlock := (offset + length - 1) / blockDataSize
+	start := int64(fileHeaderSize) + firstBlock*blockSize
+	end := int64(fileHeaderSize) + (lastBlock+1)*blockSize
+	if end > encryptedSize {
+		end = encryptedSize
+	}
+	return start, end - start
+}
+
+type decrypter struct {
+	cipher  *Cipher
+	src     io.Reader
+	nonce   Nonce
+	block   int64
+	discard int64
+	left    int64
+
+	buf      []byte
+	plainBuf []byte
+	plain    []byte
+	err      error
+}
+
+// DecryptRange returns the original bytes [offset, offset+length) of the
+// encrypted file whose header holds nonce, reading src which must start at
+// the range returned by CipherRange
+func (c *Cipher) DecryptRange(src io.Reader, nonce Nonce, offset int64, length int64) io.Reader {
+	return &decrypter{
+		cipher:   c,
+		src:      src,
+		nonce:    nonce,
+		block:    offset / blockDataSize,
+		discard:  offset % blockDataSize,
+		left:     length,
+		buf:      make([]byte, blockSize),
+		plainBuf: make([]byte, 0, blockDataSize),
+	}
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.left <= 0 {
+			return 0, io.EOF
+		}
+		if d.err != nil {
+			return 0, d.err
+		}
+		n, err := io.ReadFull(d.src, d.buf)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			// only the last block is short
+			d.err = io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+		if n <= blockHeaderSize {
+			return 0, io.ErrUnexpectedEOF
+		}
+		plain, ok := secretbox.Open(d.plainBuf[:0], d.buf[:n], d.nonce.add(uint64(d.block)), &d.cipher.dataKey)
+		if !ok {
+			return 0, ErrBadBlock
+		}
+		d.block++
+		if d.discard > 0 {
+			if d.discard >= int64(len(plain)) {
+				return 0, io.ErrUnexpectedEOF
+			}
+			plain = plain[d.discard:]
+			d.discard = 0
+		}
+		if int64(len(plain)) > d.left {
+			plain = plain[:d.left]
+		}
+		d.plain = plain
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	d.left -= int64(n)
+	return n, nil
+}
+
+type streamEncrypter struct {
+	cipher   *Cipher
+	src      io.Reader
+	nonce    Nonce
+	block    uint64
+	plainBuf []byte
+	sealed   []byte
+	out      []byte
+	err      error
+}
+
+// EncryptReader returns the encrypted form of everything read from src,
+// for sources whose size is not known in advance
+func (c *Cipher) EncryptReader(src io.Reader, nonce Nonce) io.Reader {
+	return &streamEncrypter{
+		cipher:   c,
+		src:      src,
+		nonce:    nonce,
+		plainBuf: make([]byte, blockDataSize),
+		out:      append([]byte(fileMagic), nonce[:]...),
+	}
+}
+
+func (e *streamEncrypter) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+		n, err := io.ReadFull(e.src, e.plainBuf)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			e.err = io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			e.sealed = secretbox.Seal(e.sealed[:0], e.plainBuf[:n], e.nonce.add(e.block), &e.cipher.dataKey)
+			e.out = e.sealed
+			e.block++
+		}
+	}
+
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
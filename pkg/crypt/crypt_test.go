@@ -0,0 +1,223 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+// The golden vectors below were produced by the cipher of rclone v1.63.1's
+// crypt backend with password "potato", password2 "sausage", standard file
+// name encryption and base32 name encoding.
+const (
+	testPassword = "potato"
+	testSalt     = "sausage"
+)
+
+func newTestCipher(t *testing.T) *Cipher {
+	t.Helper()
+	c, err := New(testPassword, testSalt, NameEncryptionStandard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// testData returns size bytes counting up from 0
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+// testNonce is the nonce of the golden files, chosen so the block nonces
+// carry across bytes
+var testNonce = Nonce{0xf0, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8, 0xf9, 0xfa, 0xfb, 0xfc, 0xfd, 0xfe, 0xff, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestFileNameGolden(t *testing.T) {
+	c := newTestCipher(t)
+	tests := []struct {
+		name      string
+		encrypted string
+	}{
+		{"file.txt", "ee1okdgjsatr65qq67i0aih9og"},
+		{"a", "0pafnuo05kiri5rkftm2fsb7b4"},
+		{"sixteen byte nam", "n6la6530mh5esai8khpash954voev5gofiiod3dt0bf8o1qs8fl0"},
+		{"Ünïcode name.bin", "6d1pk5dle92sh67k8h2h8tm8drjgg4fv5mtjm9tr7av9vk79hjdg"},
+	}
+	for _, test := range tests {
+		if got := c.EncryptFileName(test.name); got != test.encrypted {
+			t.Errorf("EncryptFileName(%q) = %q, want %q", test.name, got, test.encrypted)
+		}
+		got, err := c.DecryptFileName(test.encrypted)
+		if err != nil || got != test.name {
+			t.Errorf("DecryptFileName(%q) = %q, %v, want %q", test.encrypted, got, err, test.name)
+		}
+	}
+
+	// without password2 rclone's built in salt is used
+	c, err := New(testPassword, "", NameEncryptionStandard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.EncryptFileName("file.txt"), "dliujkifo15pa0t31sl422pt6k"; got != want {
+		t.Errorf("EncryptFileName with the default salt = %q, want %q", got, want)
+	}
+
+	if _, err := c.DecryptFileName("file.txt"); err != ErrBadName {
+		t.Errorf("DecryptFileName of a plain name: got %v, want %v", err, ErrBadName)
+	}
+}
+
+func TestFileNameOff(t *testing.T) {
+	c, err := New(testPassword, testSalt, NameEncryptionOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.EncryptFileName("file.txt"); got != "file.txt" {
+		t.Fatalf("got %q, want the name unchanged", got)
+	}
+}
+
+func TestDataGolden(t *testing.T) {
+	c := newTestCipher(t)
+	header := "52434c4f4e450000f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff0001020304050607"
+	tests := []struct {
+		size      int
+		encrypted string
+	}{
+		{0, header},
+		{1, header + "b62ed1ec477a66e05ca2b8f68a9cfeff93"},
+		{100, header + "d4410c770e95073d40e8a53a4e45a35d93db8d42f8b24053982a8340f0840339332573a6c370ff55ff41110f841901f196c26d921f812a5e091b41ca605afde3e6dccbe85651a23a3325bea3c9c55100505cb3740d94d3610b98a124892e643f771099e3cd79173ebce390a500d642f86ffa1301"},
+	}
+	for _, test := range tests {
+		data := testData(test.size)
+		want := mustDecodeHex(t, test.encrypted)
+
+		if got := c.EncryptedSize(int64(test.size)); got != int64(len(want)) {
+			t.Errorf("EncryptedSize(%d) = %d, want %d", test.size, got, len(want))
+		}
+		got, err := io.ReadAll(c.EncryptRange(bytes.NewReader(data), int64(test.size), testNonce, 0, int64(len(want))))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("EncryptRange of %d bytes = %x, %v, want %x", test.size, got, err, want)
+		}
+		got, err = io.ReadAll(c.EncryptReader(bytes.NewReader(data), testNonce))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("EncryptReader of %d bytes = %x, %v, want %x", test.size, got, err, want)
+		}
+
+		nonce, err := ReadNonce(bytes.NewReader(want))
+		if err != nil || nonce != testNonce {
+			t.Errorf("ReadNonce = %s, %v, want %s", nonce, err, testNonce)
+		}
+		plain, err := io.ReadAll(c.DecryptRange(bytes.NewReader(want[HeaderSize():]), nonce, 0, int64(test.size)))
+		if err != nil || !bytes.Equal(plain, data) {
+			t.Errorf("DecryptRange of %d bytes = %x, %v, want %x", test.size, plain, err, data)
+		}
+	}
+}
+
+func TestDataGoldenBlocks(t *testing.T) {
+	c := newTestCipher(t)
+	// the block nonces carry over the first eight bytes
+	nonce := Nonce{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	size := 20*blockDataSize + 7
+	data := testData(size)
+
+	encrypted, err := io.ReadAll(c.EncryptReader(bytes.NewReader(data), nonce))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(encrypted)
+	if got, want := hex.EncodeToString(sum[:]), "780afa9958bb04ef2ccffda898eb0a52a11669e94a43d40032381f553f849466"; got != want {
+		t.Fatalf("sha256 of %d encrypted bytes = %s, want %s", len(encrypted), got, want)
+	}
+	if got := c.EncryptedSize(int64(size)); got != int64(len(encrypted)) {
+		t.Fatalf("EncryptedSize(%d) = %d, want %d", size, got, len(encrypted))
+	}
+	if got, err := c.DecryptedSize(int64(len(encrypted))); err != nil || got != int64(size) {
+		t.Fatalf("DecryptedSize(%d) = %d, %v, want %d", len(encrypted), got, err, size)
+	}
+}
+
+func TestRangeRoundTrip(t *testing.T) {
+	c := newTestCipher(t)
+	nonce, err := NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(3*blockDataSize + 123)
+	data := testData(int(size))
+
+	encrypted, err := io.ReadAll(c.EncryptReader(bytes.NewReader(data), nonce))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// parts are cut anywhere in the encrypted file and sent on their own
+	var joined []byte
+	for _, cut := range []int64{0, 10, 5000, blockSize + 1, 2*blockSize + 40} {
+		end := int64(len(encrypted))
+		if cut+9000 < end {
+			end = cut + 9000
+		}
+		part, err := io.ReadAll(c.EncryptRange(bytes.NewReader(data), size, nonce, cut, end-cut))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(part, encrypted[cut:end]) {
+			t.Fatalf("EncryptRange at %d differs from the encrypted stream", cut)
+		}
+	}
+	for offset := int64(0); offset < int64(len(encrypted)); offset += 70000 {
+		end := offset + 70000
+		if end > int64(len(encrypted)) {
+			end = int64(len(encrypted))
+		}
+		part, err := io.ReadAll(c.EncryptRange(bytes.NewReader(data), size, nonce, offset, end-offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		joined = append(joined, part...)
+	}
+	if !bytes.Equal(joined, encrypted) {
+		t.Fatal("parts of the encrypted file do not join up")
+	}
+
+	for _, r := range []struct{ offset, length int64 }{
+		{0, size},
+		{1, 10},
+		{blockDataSize - 5, 10},
+		{2*blockDataSize + 100, size - 2*blockDataSize - 100},
+	} {
+		start, length := c.CipherRange(r.offset, r.length, int64(len(encrypted)))
+		plain, err := io.ReadAll(c.DecryptRange(bytes.NewReader(encrypted[start:start+length]), nonce, r.offset, r.length))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plain, data[r.offset:r.offset+r.length]) {
+			t.Fatalf("DecryptRange(%d, %d) differs from the original", r.offset, r.length)
+		}
+	}
+
+	other, err := New("other", testSalt, NameEncryptionStandard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(other.DecryptRange(bytes.NewReader(encrypted[HeaderSize():]), nonce, 0, size)); err != ErrBadBlock {
+		t.Fatalf("decrypt with another password: got %v, want %v", err, ErrBadBlock)
+	}
+}
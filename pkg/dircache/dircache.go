@@ -0,0 +1,126 @@
+package dircache
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// state is the content of the cache file. Ids only mean something on the
+// server and for the user they were read from.
+type state struct {
+	Owner string            `json:"owner"`
+	Dirs  map[string]string `json:"dirs"`
+}
+
+// Cache maps remote folder paths to their ids, so each folder is looked up
+// once. A cache opened from a file keeps the ids between runs.
+//
+// An id may be stale when the folder was removed and created again by
+// someone else, so the cache is only used where a wrong id is harmless.
+type Cache struct {
+	mu    sync.Mutex
+	path  string
+	owner string
+	dirs  map[string]string
+	dirty bool
+}
+
+// New returns an empty cache held in memory only
+func New() *Cache {
+	return &Cache{dirs: make(map[string]string)}
+}
+
+// Open loads the cache saved at path for owner, which identifies the server
+// and user the ids belong to. A missing file, or one saved for another
+// owner, gives an empty cache.
+func Open(path string, owner string) (*Cache, error) {
+	c := New()
+	c.path, c.owner = path, owner
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved state
+	if err := json.Unmarshal(data, &saved); err != nil {
+		// a damaged cache is rebuilt rather than failing the run
+		c.dirty = true
+		return c, nil
+	}
+	if saved.Owner == owner && saved.Dirs != nil {
+		c.dirs = saved.Dirs
+	} else {
+		c.dirty = true
+	}
+	return c, nil
+}
+
+// Get returns the id of the folder at remotePath
+func (c *Cache) Get(remotePath string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, ok := c.dirs[remotePath]
+	return id, ok
+}
+
+// Put records id as the id of the folder at remotePath
+func (c *Cache) Put(remotePath string, id string) {
+	if id == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dirs[remotePath] != id {
+		c.dirs[remotePath] = id
+		c.dirty = true
+	}
+}
+
+// Len returns the number of cached folders
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.dirs)
+}
+
+// Save writes the cache back to the file it was opened from. It does
+// nothing for caches held in memory or without changes.
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.path == "" || !c.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(state{Owner: c.owner, Dirs: c.dirs})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	c.dirty = false
+	return nil
+}
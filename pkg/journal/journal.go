@@ -0,0 +1,377 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"uploader/pkg/types"
+)
+
+const (
+	entryPart  = "part"
+	entryFile  = "file"
+	entryNonce = "nonce"
+	// entryPartSize records the size a file is cut in, as its parts only
+	// fit together with others of the same size
+	entryPartSize = "partSize"
+)
+
+// KeepCompleted is how long completed files are remembered. Older ones are
+// dropped when the journal is opened, the conflict check on the remote folder
+// still skips them.
+const KeepCompleted = 30 * 24 * time.Hour
+
+// entry is a single line of the journal file
+type entry struct {
+	Type      string          `json:"type"`
+	Key       string          `json:"key"`
+	Path      string          `json:"path"`
+	Part      *types.PartFile `json:"part,omitempty"`
+	Nonce     string          `json:"nonce,omitempty"`
+	PartSize  int64           `json:"partSize,omitempty"`
+	Completed bool            `json:"completed,omitempty"`
+	Time      time.Time       `json:"time"`
+}
+
+// FileState is the recorded state of a single local file
+type FileState struct {
+	Path      string
+	Parts     map[int]types.PartFile
+	Nonce     string
+	PartSize  int64
+	Completed bool
+	Updated   time.Time
+}
+
+// Journal is an append-only record of finished files and parts, so an
+// interrupted run can be resumed without asking the server what it has.
+type Journal struct {
+	mu    sync.Mutex
+	file  *os.File
+	path  string
+	files map[string]*FileState
+	// lines is the number of lines read by load
+	lines int
+}
+
+// Open loads the journal at path, creating it if needed. Files completed
+// more than KeepCompleted ago and files whose local copy is gone or changed
+// are dropped, and the journal is compacted to a single line per known part
+// or file when that saves any lines.
+func Open(path string) (*Journal, error) {
+	j := &Journal{
+		path:  path,
+		files: make(map[string]*FileState),
+	}
+
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+
+	j.prune(time.Now())
+	if j.lines > j.entries() {
+		if err := j.compact(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return nil, err
+	}
+	var err error
+	j.file, err = os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// Key identifies a local file uploaded to a remote directory. A change in
+// size or modification time gives a new key, so stale parts are never reused.
+func Key(filePath string, destDir string, info os.FileInfo) string {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		absPath = filePath
+	}
+	return fmt.Sprintf("%s|%s|%d|%d", absPath, destDir, info.Size(), info.ModTime().UnixNano())
+}
+
+func (j *Journal) load() error {
+	f, err := os.Open(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// a torn final line is expected when the process is killed mid-write
+			continue
+		}
+		j.lines++
+		j.apply(e)
+	}
+	return scanner.Err()
+}
+
+// prune drops the files completed more than KeepCompleted before now and
+// the files whose local copy no longer matches their key
+func (j *Journal) prune(now time.Time) {
+	for key, state := range j.files {
+		if state.Completed && now.Sub(state.Updated) > KeepCompleted {
+			delete(j.files, key)
+			continue
+		}
+		if !localMatches(key, state.Path) {
+			delete(j.files, key)
+		}
+	}
+}
+
+// localMatches reports whether the local file at path still has the size
+// and modification time recorded in key. Relative paths of older journals
+// depend on the directory of the run which wrote them and are kept.
+func localMatches(key string, path string) bool {
+	if !filepath.IsAbs(path) {
+		return true
+	}
+	fields := strings.Split(key, "|")
+	if len(fields) < 4 {
+		return true
+	}
+	size, err := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+	if err != nil {
+		return true
+	}
+	modTime, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		return true
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return !os.IsNotExist(err)
+	}
+	return info.Size() == size && info.ModTime().UnixNano() == modTime
+}
+
+// entries returns the number of lines compact writes
+func (j *Journal) entries() int {
+	var n int
+	for _, state := range j.files {
+		if state.Completed {
+			n++
+			continue
+		}
+		n += len(state.Parts)
+		if state.Nonce != "" {
+			n++
+		}
+		if state.PartSize != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (j *Journal) apply(e entry) {
+	state, ok := j.files[e.Key]
+	if !ok {
+		state = &FileState{Path: e.Path, Parts: make(map[int]types.PartFile)}
+		j.files[e.Key] = state
+	}
+	switch e.Type {
+	case entryPart:
+		if e.Part != nil {
+			state.Parts[e.Part.PartNo] = *e.Part
+		}
+	case entryNonce:
+		state.Nonce = e.Nonce
+	case entryPartSize:
+		state.PartSize = e.PartSize
+	case entryFile:
+		state.Completed = e.Completed
+		if e.Completed {
+			state.Parts = make(map[int]types.PartFile)
+			state.Nonce = ""
+			state.PartSize = 0
+		}
+	}
+	if e.Time.After(state.Updated) {
+		state.Updated = e.Time
+	}
+}
+
+func (j *Journal) compact() error {
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return err
+	}
+
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for key, state := range j.files {
+		if state.Completed {
+			err = enc.Encode(entry{Type: entryFile, Key: key, Path: state.Path, Completed: true, Time: state.Updated})
+		} else {
+			if state.Nonce != "" {
+				err = enc.Encode(entry{Type: entryNonce, Key: key, Path: state.Path, Nonce: state.Nonce, Time: state.Updated})
+			}
+			if state.PartSize != 0 && err == nil {
+				err = enc.Encode(entry{Type: entryPartSize, Key: key, Path: state.Path, PartSize: state.PartSize, Time: state.Updated})
+			}
+			for _, part := range state.Parts {
+				if err != nil {
+					break
+				}
+				part := part
+				err = enc.Encode(entry{Type: entryPart, Key: key, Path: state.Path, Part: &part, Time: state.Updated})
+			}
+		}
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, j.path)
+}
+
+func (j *Journal) write(e entry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e.Time = time.Now()
+	if absPath, err := filepath.Abs(e.Path); err == nil {
+		e.Path = absPath
+	}
+	j.apply(e)
+
+	if j.file == nil {
+		return os.ErrClosed
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(append(b, '\n'))
+	return err
+}
+
+// IsCompleted reports whether the file for key was fully uploaded
+func (j *Journal) IsCompleted(key string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	state, ok := j.files[key]
+	return ok && state.Completed
+}
+
+// Parts returns the parts already uploaded for key, by part number
+func (j *Journal) Parts(key string) map[int]types.PartFile {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	parts := make(map[int]types.PartFile)
+	if state, ok := j.files[key]; ok {
+		for partNo, part := range state.Parts {
+			parts[partNo] = part
+		}
+	}
+	return parts
+}
+
+// AddPart records an uploaded part of the file for key
+func (j *Journal) AddPart(key string, path string, part types.PartFile) error {
+	return j.write(entry{Type: entryPart, Key: key, Path: path, Part: &part})
+}
+
+// Nonce returns the encryption nonce recorded for key, or "" when none was
+func (j *Journal) Nonce(key string) string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if state, ok := j.files[key]; ok {
+		return state.Nonce
+	}
+	return ""
+}
+
+// SetNonce records the encryption nonce of the file for key, parts
+// encrypted with it can only be resumed with the same nonce
+func (j *Journal) SetNonce(key string, path string, nonce string) error {
+	return j.write(entry{Type: entryNonce, Key: key, Path: path, Nonce: nonce})
+}
+
+// PartSize returns the part size recorded for key, or 0 when none was
+func (j *Journal) PartSize(key string) int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if state, ok := j.files[key]; ok {
+		return state.PartSize
+	}
+	return 0
+}
+
+// SetPartSize records the size the file for key is cut in, parts of
+// another size cannot be resumed with it
+func (j *Journal) SetPartSize(key string, path string, partSize int64) error {
+	return j.write(entry{Type: entryPartSize, Key: key, Path: path, PartSize: partSize})
+}
+
+// Complete records the file for key as fully uploaded
+func (j *Journal) Complete(key string, path string) error {
+	return j.write(entry{Type: entryFile, Key: key, Path: path, Completed: true})
+}
+
+// Interrupted returns the files which have some parts uploaded but were
+// never completed, oldest first.
+func (j *Journal) Interrupted() []FileState {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var states []FileState
+	for _, state := range j.files {
+		if !state.Completed && len(state.Parts) > 0 {
+			states = append(states, *state)
+		}
+	}
+	sort.Slice(states, func(i, k int) bool {
+		return states[i].Updated.Before(states[k].Updated)
+	})
+	return states
+}
+
+// Close closes the underlying journal file
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
@@ -0,0 +1,90 @@
+package journal
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"uploader/pkg/types"
+)
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var n int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+	}
+	return n
+}
+
+func TestOpenPrunes(t *testing.T) {
+	dir := t.TempDir()
+	journalPath := filepath.Join(dir, "uploader.journal")
+
+	keep, changed, removed := filepath.Join(dir, "keep"), filepath.Join(dir, "changed"), filepath.Join(dir, "removed")
+	keys := make(map[string]string)
+	for _, name := range []string{keep, changed, removed} {
+		if err := os.WriteFile(name, []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = Key(name, "/", info)
+	}
+
+	j, err := Open(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range keys {
+		if err := j.AddPart(key, name, types.PartFile{PartNo: 1, PartId: 1, Size: 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := j.Complete(keys[keep], keep); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	if err := os.WriteFile(changed, []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = Open(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !j.IsCompleted(keys[keep]) {
+		t.Fatal("completed file dropped")
+	}
+	if len(j.Parts(keys[changed])) != 0 || len(j.Parts(keys[removed])) != 0 {
+		t.Fatal("parts of a changed or removed file kept")
+	}
+	j.Close()
+	if got := countLines(t, journalPath); got != 1 {
+		t.Fatalf("compacted to %d lines, want 1", got)
+	}
+
+	// the completed file is forgotten once it is old enough
+	j, err = Open(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.prune(time.Now().Add(KeepCompleted + time.Hour))
+	if j.IsCompleted(keys[keep]) {
+		t.Fatal("completed file kept past KeepCompleted")
+	}
+	j.Close()
+}
@@ -0,0 +1,120 @@
+package partsize
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// MaxPart is the largest part Telegram stores in a single message
+const MaxPart = 2000 * fs.Mebi
+
+// Default is the part size used when PART_SIZE is not set, and by auto for
+// content whose size is not known up front
+const Default = 1000 * fs.Mebi
+
+// Size is the PART_SIZE setting, a size or Auto
+type Size fs.SizeSuffix
+
+// Auto picks a part size for each file
+const Auto Size = -1
+
+func (s Size) String() string {
+	if s == Auto {
+		return "auto"
+	}
+	return fs.SizeSuffix(s).String()
+}
+
+func (s *Size) Set(value string) error {
+	if strings.EqualFold(strings.TrimSpace(value), "auto") {
+		*s = Auto
+		return nil
+	}
+	var size fs.SizeSuffix
+	if err := size.Set(value); err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("part size %q is negative", value)
+	}
+	*s = Size(size)
+	return nil
+}
+
+// Policy picks the part size of each file
+type Policy struct {
+	// Fixed is the size of every part, 0 picks one per file
+	Fixed int64
+	// Min and Max bound the sizes picked, Target is the number of parts
+	// aimed for
+	Min    int64
+	Max    int64
+	Target int
+}
+
+// For returns the part size of a file of size bytes. Without a fixed size
+// it is the size giving Target parts, rounded up to whole MiB and kept
+// between Min and Max, so large files get fewer parts than with a single
+// size and small ones are not padded into one huge part.
+func (p Policy) For(size int64) int64 {
+	if p.Fixed > 0 {
+		return p.Fixed
+	}
+	target := int64(p.Target)
+	if target < 1 {
+		target = 1
+	}
+	partSize := (size + target - 1) / target
+	partSize = (partSize + int64(fs.Mebi) - 1) / int64(fs.Mebi) * int64(fs.Mebi)
+	return p.clamp(partSize)
+}
+
+// Stream returns the part size of content whose size is not known
+func (p Policy) Stream() int64 {
+	if p.Fixed > 0 {
+		return p.Fixed
+	}
+	return p.clamp(int64(Default))
+}
+
+// clamp keeps partSize between Min and Max, and below MaxPart
+func (p Policy) clamp(partSize int64) int64 {
+	max := p.Max
+	if max <= 0 || max > int64(MaxPart) {
+		max = int64(MaxPart)
+	}
+	if partSize < p.Min {
+		partSize = p.Min
+	}
+	if partSize > max {
+		partSize = max
+	}
+	if partSize < 1 {
+		partSize = 1
+	}
+	return partSize
+}
+
+// Fits reports whether parts, by part number, were cut from a file of size
+// bytes at partSize, so they can be kept when its upload resumes
+func Fits(parts map[int]int64, partSize int64, size int64) bool {
+	if partSize <= 0 {
+		return false
+	}
+	total := (size + partSize - 1) / partSize
+	for partNo, partBytes := range parts {
+		if partNo < 1 || int64(partNo) > total {
+			return false
+		}
+		want := size - int64(partNo-1)*partSize
+		if want > partSize {
+			want = partSize
+		}
+		if partBytes != want {
+			return false
+		}
+	}
+	return true
+}
@@ -17,6 +17,8 @@ import (
 type progressConfig struct {
 	writer           io.Writer
 	throttleDuration time.Duration
+	bandwidthLimit   func() string
+	parts            func() string
 }
 
 type progressState struct {
@@ -95,7 +97,7 @@ func (p *Progress) StartProgress() func() {
 			case <-stopProgress:
 				ticker.Stop()
 				// fs.LogPrint = oldLogPrint
-				fmt.Println("")
+				fmt.Fprintln(p.config.writer, "")
 				return
 			}
 		}
@@ -200,6 +202,21 @@ func OptionSetThrottle(duration time.Duration) ProgressOption {
 	}
 }
 
+// OptionSetBandwidthLimit shows the bandwidth limit returned by limit in the header
+func OptionSetBandwidthLimit(limit func() string) ProgressOption {
+	return func(p *Progress) {
+		p.config.bandwidthLimit = limit
+	}
+}
+
+// OptionSetParts shows the part uploads in flight and queued, as returned by
+// parts, in the header
+func OptionSetParts(parts func() string) ProgressOption {
+	return func(p *Progress) {
+		p.config.parts = parts
+	}
+}
+
 func configureOutputWriter(w io.Writer) io.Writer {
 	writer := w
 
@@ -252,6 +269,10 @@ func (p *Progress) resetState() {
 func (p *Progress) String() (string, error) {
 	var bars strings.Builder
 
+	// the totals are summed up bar by bar, Rate waits for the whole sum
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.resetState()
 	p.updateMaxDescriptionLength()
 
@@ -262,6 +283,62 @@ func (p *Progress) String() (string, error) {
 	return bars.String(), nil
 }
 
+// Rate returns the combined rate of the transfers in progress in bytes per
+// second, the speed shown in the header, as of the last render
+func (p *Progress) Rate() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state.mu.Lock()
+	defer p.state.mu.Unlock()
+	return p.state.totalAverageRate
+}
+
+// Stats is a snapshot of the counters shown in the progress header
+type Stats struct {
+	Transferred int
+	Existing    int
+	Errors      int
+	TotalFiles  int
+	Bytes       int64
+	TotalBytes  int64
+	Elapsed     time.Duration
+}
+
+// Stats returns the current counters
+func (p *Progress) Stats() Stats {
+	p.String()
+
+	p.state.mu.Lock()
+	defer p.state.mu.Unlock()
+
+	stats := Stats{
+		Transferred: p.state.uploaded,
+		Existing:    p.state.existing,
+		Errors:      p.state.error,
+		TotalFiles:  p.state.totalTransfers,
+		Bytes:       p.state.uploadedBytes + p.state.existingBytes,
+		TotalBytes:  p.state.totalSize,
+	}
+	if !p.state.startTime.IsZero() {
+		stats.Elapsed = time.Duration(time.Since(p.state.startTime).Seconds()) * time.Second
+	}
+	return stats
+}
+
+// Summary returns a one line account of the transfers, for printing once
+// progress has stopped
+func (p *Progress) Summary() string {
+	stats := p.Stats()
+
+	bytesHumanize, bytesSuffix := humanizeBytes(float64(stats.Bytes), false)
+	totalHumanize, totalSuffix := humanizeBytes(float64(stats.TotalBytes), false)
+
+	return fmt.Sprintf("Transferred %d/%d files, %s%s/%s%s, %d errors in %s",
+		stats.Transferred+stats.Existing, stats.TotalFiles,
+		bytesHumanize, bytesSuffix, totalHumanize, totalSuffix,
+		stats.Errors, stats.Elapsed)
+}
+
 func updateProgressState(p *Progress, bar *Bar, bars *strings.Builder, index int) {
 	if !bar.IsCompleted() {
 		bar.Describe(truncateDescription(bar.state.originalDescription, p.state.maxDescriptionLength))
@@ -327,6 +404,20 @@ func (ps *progressState) String() string {
 		return ""
 	}
 
+	formatBandwidthLimit := func() string {
+		if p.config.bandwidthLimit != nil {
+			return fmt.Sprintf("Bandwidth limit: %s\n", p.config.bandwidthLimit())
+		}
+		return ""
+	}
+
+	formatParts := func() string {
+		if p.config.parts != nil {
+			return fmt.Sprintf("Parts: %s\n", p.config.parts())
+		}
+		return ""
+	}
+
 	formatElapsedTime := func() string {
 		return fmt.Sprintf("Elapsed time: %s", (time.Duration(time.Since(ps.startTime).Seconds()) * time.Second).String())
 	}
@@ -340,6 +431,10 @@ func (ps *progressState) String() string {
 	strProgressStats.WriteString(formatElapsedTime())
 	strProgressStats.WriteString("\n")
 
+	strProgressStats.WriteString(formatBandwidthLimit())
+
+	strProgressStats.WriteString(formatParts())
+
 	strProgressStats.WriteString(formatErrorInfo())
 
 	strProgressStats.WriteString("Transferring:")
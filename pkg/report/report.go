@@ -0,0 +1,268 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"uploader/pkg/pb"
+)
+
+type EventType string
+
+const (
+	Planned     EventType = "planned"
+	FileStarted EventType = "file_started"
+	PartDone    EventType = "part_done"
+	FileSkipped EventType = "file_skipped"
+	// FileConflict is sent when the destination of a file is taken
+	FileConflict EventType = "file_conflict"
+	FileDone     EventType = "file_done"
+	FileFailed   EventType = "file_failed"
+	RunSummary   EventType = "summary"
+)
+
+// Event is a single line of the newline delimited JSON output
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       EventType `json:"type"`
+	Op         string    `json:"op,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Remote     string    `json:"remote,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	PartNo     int       `json:"partNo,omitempty"`
+	TotalParts int       `json:"totalParts,omitempty"`
+	ID         string    `json:"id,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Summary    *Summary  `json:"summary,omitempty"`
+}
+
+type Status string
+
+const (
+	StatusPlanned   Status = "planned"
+	StatusRunning   Status = "running"
+	StatusDone      Status = "done"
+	StatusSkipped   Status = "skipped"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+// File is the outcome of a single transfer
+type File struct {
+	Op       string  `json:"op,omitempty"`
+	Path     string  `json:"path,omitempty"`
+	Remote   string  `json:"remote,omitempty"`
+	Status   Status  `json:"status"`
+	Size     int64   `json:"size"`
+	Duration float64 `json:"duration"`
+	ID       string  `json:"id,omitempty"`
+	Reason   string  `json:"reason,omitempty"`
+	Conflict string  `json:"conflict,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	started  time.Time
+}
+
+// Summary holds the progress counters at the end of the run
+type Summary struct {
+	Transferred int     `json:"transferred"`
+	Existing    int     `json:"existing"`
+	Errors      int     `json:"errors"`
+	TotalFiles  int     `json:"totalFiles"`
+	Bytes       int64   `json:"bytes"`
+	TotalBytes  int64   `json:"totalBytes"`
+	Elapsed     float64 `json:"elapsed"`
+}
+
+// Report is the document written by --report
+type Report struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Summary  Summary   `json:"summary"`
+	Files    []*File   `json:"files"`
+}
+
+// Reporter streams transfer events as JSON lines and collects the per file
+// outcomes for the end of run report. A nil Reporter ignores every call.
+type Reporter struct {
+	mu         sync.Mutex
+	events     *json.Encoder
+	reportPath string
+	report     Report
+	files      map[string]*File
+}
+
+// New returns a Reporter writing events to events and the report to
+// reportPath at Finish, either may be unset. It returns nil when both are.
+func New(events io.Writer, reportPath string) *Reporter {
+	if events == nil && reportPath == "" {
+		return nil
+	}
+	r := &Reporter{
+		reportPath: reportPath,
+		report:     Report{Started: time.Now(), Files: []*File{}},
+		files:      make(map[string]*File),
+	}
+	if events != nil {
+		r.events = json.NewEncoder(events)
+	}
+	return r
+}
+
+// emit writes event. Must be called with the lock held.
+func (r *Reporter) emit(event Event) {
+	if r.events == nil {
+		return
+	}
+	event.Time = time.Now()
+	r.events.Encode(event)
+}
+
+// file returns the entry of the transfer of path, starting one when needed.
+// Must be called with the lock held.
+func (r *Reporter) file(path string) *File {
+	if f, ok := r.files[path]; ok {
+		return f
+	}
+	f := &File{Path: path, Status: StatusRunning, started: time.Now()}
+	r.files[path] = f
+	r.report.Files = append(r.report.Files, f)
+	return f
+}
+
+// finish records the final status of f. Must be called with the lock held.
+func (r *Reporter) finish(f *File, status Status) {
+	f.Status = status
+	f.Duration = time.Since(f.started).Seconds()
+	// a file seen again, e.g. by watch, gets a new entry
+	delete(r.files, f.Path)
+}
+
+// Planned records an action a dry run would have taken
+func (r *Reporter) Planned(op string, path string, remote string, size int64, reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report.Files = append(r.report.Files, &File{Op: op, Path: path, Remote: remote, Status: StatusPlanned, Size: size, Reason: reason})
+	r.emit(Event{Type: Planned, Op: op, Path: path, Remote: remote, Size: size, Reason: reason})
+}
+
+// FileStarted records the start of the transfer of path to remote
+func (r *Reporter) FileStarted(path string, remote string, size int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.file(path)
+	f.Remote, f.Size = remote, size
+	r.emit(Event{Type: FileStarted, Path: path, Remote: remote, Size: size})
+}
+
+// PartDone records part partNo of path as sent
+func (r *Reporter) PartDone(path string, partNo int, totalParts int, size int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.emit(Event{Type: PartDone, Path: path, PartNo: partNo, TotalParts: totalParts, Size: size})
+}
+
+// FileSkipped records path as left alone, e.g. because it already exists
+func (r *Reporter) FileSkipped(path string, reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.file(path)
+	f.Reason = reason
+	r.finish(f, StatusSkipped)
+	r.emit(Event{Type: FileSkipped, Path: path, Remote: f.Remote, Size: f.Size, Reason: reason})
+}
+
+// FileConflict records that the destination of path was taken and how
+// that was resolved, remote is where path is sent instead
+func (r *Reporter) FileConflict(path string, remote string, resolution string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.file(path)
+	f.Remote, f.Conflict = remote, resolution
+	r.emit(Event{Type: FileConflict, Path: path, Remote: remote, Size: f.Size, Reason: resolution})
+}
+
+// FileDone records path as transferred, id is the id of the remote file
+func (r *Reporter) FileDone(path string, id string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.file(path)
+	f.ID = id
+	r.finish(f, StatusDone)
+	r.emit(Event{Type: FileDone, Path: path, Remote: f.Remote, Size: f.Size, ID: id})
+}
+
+// FileFailed records the transfer of path as failed with err
+func (r *Reporter) FileFailed(path string, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.file(path)
+	f.Error = err.Error()
+	status := StatusFailed
+	if errors.Is(err, context.Canceled) {
+		status = StatusCancelled
+	}
+	r.finish(f, status)
+	r.emit(Event{Type: FileFailed, Path: path, Remote: f.Remote, Size: f.Size, Error: f.Error})
+}
+
+// Finish emits the run summary built from stats and writes the report file
+func (r *Reporter) Finish(stats pb.Stats) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.report.Finished = time.Now()
+	r.report.Summary = Summary{
+		Transferred: stats.Transferred,
+		Existing:    stats.Existing,
+		Errors:      stats.Errors,
+		TotalFiles:  stats.TotalFiles,
+		Bytes:       stats.Bytes,
+		TotalBytes:  stats.TotalBytes,
+		Elapsed:     stats.Elapsed.Seconds(),
+	}
+	// transfers still running were interrupted before they could report
+	for _, f := range r.files {
+		r.finish(f, StatusCancelled)
+	}
+
+	summary := r.report.Summary
+	r.emit(Event{Type: RunSummary, Summary: &summary})
+
+	if r.reportPath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(&r.report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.reportPath, append(data, '\n'), 0644)
+}
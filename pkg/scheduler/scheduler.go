@@ -0,0 +1,187 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Scheduler caps the part uploads in flight across every file. When a slot
+// frees up it goes to a file which already has parts sent, so started files
+// finish before new ones begin, and among those to the file with the fewest
+// parts in flight, so parts of concurrent files are interleaved.
+type Scheduler struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	// queued is the number of parts announced by files and not started yet
+	queued  int
+	nextSeq uint64
+	waiting []*waiter
+}
+
+// File is the share of a Scheduler of a single file
+type File struct {
+	s   *Scheduler
+	seq uint64
+	// parts is the number of parts not started yet
+	parts   int
+	running int
+	started bool
+}
+
+type waiter struct {
+	file  *File
+	ready chan struct{}
+}
+
+// New returns a Scheduler running up to limit parts at once
+func New(limit int) *Scheduler {
+	if limit < 1 {
+		limit = 1
+	}
+	return &Scheduler{limit: limit}
+}
+
+// File registers a file of parts parts, which take their slots with Acquire.
+// Call Done once the file needs no more slots.
+func (s *Scheduler) File(parts int) *File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextSeq++
+	s.queued += parts
+	return &File{s: s, seq: s.nextSeq, parts: parts}
+}
+
+// Limit returns the number of parts run at once
+func (s *Scheduler) Limit() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limit
+}
+
+// SetLimit changes the number of parts run at once. Parts in flight above a
+// lowered limit finish, new ones wait until the count is below it.
+func (s *Scheduler) SetLimit(limit int) {
+	if limit < 1 {
+		limit = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.grant()
+}
+
+// Running returns the number of parts in flight
+func (s *Scheduler) Running() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+// Queued returns the number of parts of registered files not started yet
+func (s *Scheduler) Queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queued
+}
+
+// String describes the parts in flight and queued for the progress header
+func (s *Scheduler) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("%d/%d active, %d queued", s.running, s.limit, s.queued)
+}
+
+// before reports whether a should be given a slot before b
+func before(a, b *File) bool {
+	if a.started != b.started {
+		return a.started
+	}
+	if a.running != b.running {
+		return a.running < b.running
+	}
+	return a.seq < b.seq
+}
+
+// grant hands free slots to waiting parts. Must be called with the lock held.
+func (s *Scheduler) grant() {
+	for s.running < s.limit && len(s.waiting) > 0 {
+		best := 0
+		for i, w := range s.waiting[1:] {
+			if before(w.file, s.waiting[best].file) {
+				best = i + 1
+			}
+		}
+		w := s.waiting[best]
+		s.waiting = append(s.waiting[:best], s.waiting[best+1:]...)
+		s.start(w.file)
+		close(w.ready)
+	}
+}
+
+// start counts a part of f as in flight. Must be called with the lock held.
+func (s *Scheduler) start(f *File) {
+	s.running++
+	f.running++
+	f.started = true
+	if f.parts > 0 {
+		f.parts--
+		s.queued--
+	}
+}
+
+// Acquire waits for a slot for the next part of f. It returns the context
+// error when ctx is done first. Every successful Acquire must be followed
+// by a Release.
+func (f *File) Acquire(ctx context.Context) error {
+	s := f.s
+	s.mu.Lock()
+	if len(s.waiting) == 0 && s.running < s.limit {
+		s.start(f)
+		s.mu.Unlock()
+		return nil
+	}
+	w := &waiter{file: f, ready: make(chan struct{})}
+	s.waiting = append(s.waiting, w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, waiting := range s.waiting {
+		if waiting == w {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			return ctx.Err()
+		}
+	}
+	// the slot was granted while giving up, hand it on
+	s.running--
+	f.running--
+	s.grant()
+	return ctx.Err()
+}
+
+// Release frees the slot of a part of f which is no longer in flight
+func (f *File) Release() {
+	s := f.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	f.running--
+	s.grant()
+}
+
+// Done drops the parts of f which were never started from the queue
+func (f *File) Done() {
+	s := f.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued -= f.parts
+	f.parts = 0
+}
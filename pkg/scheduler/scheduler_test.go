@@ -0,0 +1,182 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// acquire calls f.Acquire in the background and returns a channel closed
+// once it got a slot. It waits until the part is queued.
+func acquire(t *testing.T, f *File) <-chan struct{} {
+	t.Helper()
+	s := f.s
+	s.mu.Lock()
+	waiting := len(s.waiting)
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		if err := f.Acquire(context.Background()); err != nil {
+			t.Error(err)
+		}
+		close(done)
+	}()
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		queued := len(s.waiting) > waiting
+		s.mu.Unlock()
+		if queued {
+			return done
+		}
+		select {
+		case <-done:
+			return done
+		default:
+		}
+	}
+	t.Fatal("part neither queued nor started")
+	return nil
+}
+
+func granted(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	case <-time.After(50 * time.Millisecond):
+		return false
+	}
+}
+
+func TestStartedFilesFirst(t *testing.T) {
+	s := New(1)
+	started, fresh := s.File(2), s.File(1)
+	if err := started.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	freshDone := acquire(t, fresh)
+	startedDone := acquire(t, started)
+	started.Release()
+
+	if !granted(startedDone) {
+		t.Fatal("started file did not get the slot")
+	}
+	if granted(freshDone) {
+		t.Fatal("new file got a slot beyond the limit")
+	}
+	started.Release()
+	if !granted(freshDone) {
+		t.Fatal("new file did not get the freed slot")
+	}
+}
+
+func TestFewestRunningFirst(t *testing.T) {
+	s := New(3)
+	busy, idle := s.File(3), s.File(2)
+	for _, f := range []*File{busy, busy, idle} {
+		if err := f.Acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	busyDone := acquire(t, busy)
+	idleDone := acquire(t, idle)
+	idle.Release()
+
+	if !granted(idleDone) {
+		t.Fatal("file with fewer parts in flight did not get the slot")
+	}
+	busy.Release()
+	if !granted(busyDone) {
+		t.Fatal("busy file did not get the freed slot")
+	}
+}
+
+func TestAcquireCancelled(t *testing.T) {
+	s := New(1)
+	f := s.File(2)
+	if err := f.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := f.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	f.Release()
+	if got := s.Running(); got != 0 {
+		t.Fatalf("%d parts running, want 0", got)
+	}
+}
+
+func TestQueued(t *testing.T) {
+	s := New(2)
+	a, b := s.File(3), s.File(2)
+	if got := s.Queued(); got != 5 {
+		t.Fatalf("%d parts queued, want 5", got)
+	}
+	if err := a.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Queued(); got != 4 {
+		t.Fatalf("%d parts queued, want 4", got)
+	}
+	a.Done()
+	b.Done()
+	if got := s.Queued(); got != 0 {
+		t.Fatalf("%d parts queued after Done, want 0", got)
+	}
+	if got, want := s.String(), "1/2 active, 0 queued"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestTuner(t *testing.T) {
+	s := New(4)
+	s.File(100)
+	rate := 0.0
+	tuner := NewTuner(s, 2, 6, func() float64 { return rate }, zap.NewNop())
+
+	steps := []struct {
+		rate  float64
+		limit int
+	}{
+		{100, 5}, // improved, raise
+		{200, 6}, // improved, raise
+		{300, 6}, // improved, at the maximum
+		{300, 6}, // no gain, hold
+		{400, 6}, // improved, at the maximum
+	}
+	for i, step := range steps {
+		rate = step.rate
+		tuner.step()
+		if got := s.Limit(); got != step.limit {
+			t.Fatalf("step %d: limit %d, want %d", i, got, step.limit)
+		}
+	}
+
+	s.SetLimit(5)
+	rate = 500
+	tuner.step()
+	rate = 500
+	tuner.step()
+	if got := s.Limit(); got != 5 {
+		t.Fatalf("raise without gain not taken back: limit %d, want 5", got)
+	}
+
+	tuner.Throttled()
+	if got := s.Limit(); got != 2 {
+		t.Fatalf("limit %d after throttling, want 2", got)
+	}
+	tuner.Throttled()
+	rate = 1000
+	tuner.step()
+	if got := s.Limit(); got != 2 {
+		t.Fatalf("limit %d right after throttling, want 2", got)
+	}
+}
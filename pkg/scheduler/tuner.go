@@ -0,0 +1,152 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TuneInterval is how often the Tuner looks at the throughput
+const TuneInterval = 5 * time.Second
+
+// rateGain is the share by which throughput must grow for a raised limit to
+// count as an improvement, smaller changes are noise
+const rateGain = 0.05
+
+// Tuner adjusts the limit of a Scheduler between min and max: one more
+// part at a time while the throughput keeps improving, half as many as soon
+// as the server throttles. The decision of each step is logged and kept for
+// the progress header.
+type Tuner struct {
+	s        *Scheduler
+	min, max int
+	rate     func() float64
+	logger   *zap.Logger
+
+	mu sync.Mutex
+	// lastRate is the throughput at the previous step, raised tells whether
+	// that step raised the limit
+	lastRate      float64
+	raised        bool
+	lastThrottled time.Time
+	decision      string
+}
+
+// NewTuner returns a Tuner of s reading the throughput, in bytes per second,
+// from rate. The limit of s is moved between min and max.
+func NewTuner(s *Scheduler, min int, max int, rate func() float64, logger *zap.Logger) *Tuner {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	t := &Tuner{s: s, min: min, max: max, rate: rate, logger: logger, decision: "starting"}
+	if limit := s.Limit(); limit < min {
+		s.SetLimit(min)
+	} else if limit > max {
+		s.SetLimit(max)
+	}
+	return t
+}
+
+// Run adjusts the limit every TuneInterval until ctx is done
+func (t *Tuner) Run(ctx context.Context) {
+	ticker := time.NewTicker(TuneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.step()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// step raises the limit when the throughput improved since the last step
+// and parts are waiting for a slot, and takes a raise back when it did not
+// help
+func (t *Tuner) step() {
+	t.mu.Lock()
+	rate := t.rate()
+	limit := t.s.Limit()
+	lastRate := t.lastRate
+	t.lastRate = rate
+
+	var change *change
+	switch {
+	case time.Since(t.lastThrottled) < TuneInterval:
+		// give the lowered limit a full interval before probing again
+		t.raised = false
+	case t.raised && rate < lastRate*(1+rateGain) && limit > t.min:
+		change = t.setLimit(limit-1, "lowered, no gain from the last raise", rate)
+		t.raised = false
+	case rate > lastRate*(1+rateGain) && limit < t.max && t.s.Queued() > 0:
+		change = t.setLimit(limit+1, "raised, throughput improved", rate)
+		t.raised = true
+	default:
+		t.raised = false
+		t.decision = fmt.Sprintf("holding at %d", limit)
+	}
+	t.mu.Unlock()
+
+	t.log(change)
+}
+
+// Throttled halves the limit, at most once per TuneInterval as the parts in
+// flight when the server pushes back all fail together
+func (t *Tuner) Throttled() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if time.Since(t.lastThrottled) < TuneInterval {
+		t.mu.Unlock()
+		return
+	}
+	t.lastThrottled = time.Now()
+	t.raised = false
+	limit := t.s.Limit() / 2
+	if limit < t.min {
+		limit = t.min
+	}
+	change := t.setLimit(limit, "backed off, server throttled", t.rate())
+	t.mu.Unlock()
+
+	t.log(change)
+}
+
+// change is a limit set by the Tuner
+type change struct {
+	from, to int
+	reason   string
+	rate     float64
+}
+
+// setLimit applies limit and records why. Must be called with the lock held.
+func (t *Tuner) setLimit(limit int, reason string, rate float64) *change {
+	previous := t.s.Limit()
+	t.s.SetLimit(limit)
+	t.decision = fmt.Sprintf("%s from %d", reason, previous)
+	return &change{from: previous, to: limit, reason: reason, rate: rate}
+}
+
+// log writes change to the debug log. It must be called without the lock,
+// as the log may be drawn along with the progress header, which asks String.
+func (t *Tuner) log(c *change) {
+	if c == nil {
+		return
+	}
+	t.logger.Debug("tuned part uploads", zap.Int("from", c.from), zap.Int("to", c.to), zap.String("reason", c.reason), zap.Float64("bytesPerSecond", c.rate))
+}
+
+// String describes the last decision for the progress header
+func (t *Tuner) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return fmt.Sprintf("%s, bounds %d-%d", t.decision, t.min, t.max)
+}
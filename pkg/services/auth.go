@@ -0,0 +1,197 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"uploader/pkg/types"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/rest"
+	"go.uber.org/zap"
+)
+
+// SessionCookie is the cookie Teldrive keeps the session token in
+const SessionCookie = "access_token"
+
+// ErrSessionRejected is returned when Teldrive does not accept the session token
+var ErrSessionRejected = errors.New("session rejected")
+
+// LoginPrompts asks the user for what Telegram's sign in needs
+type LoginPrompts struct {
+	// Code returns the login code Telegram sent to the phone
+	Code func() (string, error)
+	// Password returns the two-step verification password
+	Password func() (string, error)
+	// QR shows the tg://login link to scan with a signed in Telegram app
+	QR func(loginURL string) error
+}
+
+// AuthService signs in to Teldrive and checks session tokens
+type AuthService struct {
+	http   *rest.Client
+	pacer  *fs.Pacer
+	ctx    context.Context
+	logger *zap.Logger
+}
+
+func NewAuthService(
+	http *rest.Client,
+	pacer *fs.Pacer,
+	ctx context.Context,
+	logger *zap.Logger,
+) *AuthService {
+	return &AuthService{
+		http:   http,
+		pacer:  pacer,
+		ctx:    ctx,
+		logger: logger,
+	}
+}
+
+// Session returns the session of the token the client sends, or an error
+// wrapping ErrSessionRejected when Teldrive does not accept it
+func (a *AuthService) Session() (types.Session, error) {
+	opts := rest.Opts{
+		Method: "GET",
+		Path:   "/api/auth/session",
+	}
+
+	var (
+		session types.Session
+		resp    *http.Response
+		err     error
+	)
+
+	err = a.pacer.Call(func() (bool, error) {
+		resp, err = a.http.CallJSON(a.ctx, &opts, nil, &session)
+		return ShouldRetry(a.ctx, resp, err)
+	})
+
+	if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		return session, fmt.Errorf("%w with status %d", ErrSessionRejected, resp.StatusCode)
+	}
+	if err != nil {
+		return session, fmt.Errorf("get session failed: %w", err)
+	}
+	if session.UserId == 0 {
+		return session, fmt.Errorf("%w: invalid session", ErrSessionRejected)
+	}
+	return session, nil
+}
+
+// Login signs in to Telegram through the Teldrive at apiURL, by scanning a
+// QR code when phone is empty or with a code sent to phone otherwise, and
+// returns the new session token. The client sends the token from then on.
+func (a *AuthService) Login(apiURL string, phone string, prompts LoginPrompts) (string, error) {
+	wsURL, err := url.Parse(apiURL)
+	if err != nil {
+		return "", err
+	}
+	switch wsURL.Scheme {
+	case "https":
+		wsURL.Scheme = "wss"
+	default:
+		wsURL.Scheme = "ws"
+	}
+	wsURL.Path = path.Join(wsURL.Path, "/api/auth/ws")
+
+	conn, _, err := websocket.Dial(a.ctx, wsURL.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("connect to login websocket failed: %w", err)
+	}
+	defer conn.CloseNow()
+
+	start := types.LoginMessage{AuthType: "qr"}
+	if phone != "" {
+		start = types.LoginMessage{AuthType: "phone", Message: "sendcode", PhoneNo: phone}
+	}
+	if err := wsjson.Write(a.ctx, conn, start); err != nil {
+		return "", err
+	}
+
+	for {
+		var event types.LoginEvent
+		if err := wsjson.Read(a.ctx, conn, &event); err != nil {
+			return "", fmt.Errorf("login failed: %w", err)
+		}
+		a.logger.Debug("login event", zap.String("type", event.Type), zap.String("message", event.Message))
+
+		var reply *types.LoginMessage
+		switch {
+		case event.Type == "error":
+			return "", fmt.Errorf("login failed: %s", event.Message)
+		case event.Message == "success":
+			conn.Close(websocket.StatusNormalClosure, "")
+			return a.createSession(event.Payload)
+		case event.Message == "2FA required":
+			password, err := prompts.Password()
+			if err != nil {
+				return "", err
+			}
+			reply = &types.LoginMessage{AuthType: "2fa", Password: password}
+		default:
+			var payload struct {
+				Token         string `json:"token"`
+				PhoneCodeHash string `json:"phoneCodeHash"`
+			}
+			// events without a payload only report progress
+			json.Unmarshal(event.Payload, &payload)
+			switch {
+			case payload.Token != "":
+				if err := prompts.QR(payload.Token); err != nil {
+					return "", err
+				}
+			case payload.PhoneCodeHash != "":
+				code, err := prompts.Code()
+				if err != nil {
+					return "", err
+				}
+				reply = &types.LoginMessage{AuthType: "phone", Message: "signin", PhoneNo: phone, PhoneCodeHash: payload.PhoneCodeHash, PhoneCode: code}
+			}
+		}
+
+		if reply != nil {
+			if err := wsjson.Write(a.ctx, conn, reply); err != nil {
+				return "", err
+			}
+		}
+	}
+}
+
+// createSession hands the Telegram session to Teldrive and returns the
+// token it sets in the session cookie
+func (a *AuthService) createSession(tgSession json.RawMessage) (string, error) {
+	opts := rest.Opts{
+		Method:     "POST",
+		Path:       "/api/auth/login",
+		NoResponse: true,
+	}
+
+	var (
+		resp *http.Response
+		err  error
+	)
+
+	err = a.pacer.Call(func() (bool, error) {
+		resp, err = a.http.CallJSON(a.ctx, &opts, tgSession, nil)
+		return ShouldRetry(a.ctx, resp, err)
+	})
+	if err != nil {
+		return "", fmt.Errorf("create session failed: %w", err)
+	}
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == SessionCookie && cookie.Value != "" {
+			a.http.SetCookie(&http.Cookie{Name: SessionCookie, Value: cookie.Value})
+			return cookie.Value, nil
+		}
+	}
+	return "", errors.New("create session failed: no session cookie in the response")
+}
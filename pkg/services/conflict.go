@@ -0,0 +1,154 @@
+package services
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+	"uploader/pkg/types"
+)
+
+// ConflictPolicy decides what happens to a file whose name is already taken
+// at the destination. It implements flag.Value.
+type ConflictPolicy string
+
+const (
+	// ConflictSkip leaves the existing file alone
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictOverwrite replaces the existing file
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictRename keeps both, the new file is named "name (1).ext"
+	ConflictRename ConflictPolicy = "rename"
+	// ConflictUpdate replaces the existing file when its size or modification
+	// time differs
+	ConflictUpdate ConflictPolicy = "update"
+)
+
+// ConflictPolicies lists every policy, for usage messages
+var ConflictPolicies = []ConflictPolicy{ConflictSkip, ConflictOverwrite, ConflictRename, ConflictUpdate}
+
+func (p *ConflictPolicy) String() string {
+	if *p == "" {
+		return string(ConflictSkip)
+	}
+	return string(*p)
+}
+
+func (p *ConflictPolicy) Set(value string) error {
+	for _, policy := range ConflictPolicies {
+		if string(policy) == value {
+			*p = policy
+			return nil
+		}
+	}
+	names := make([]string, len(ConflictPolicies))
+	for i, policy := range ConflictPolicies {
+		names[i] = string(policy)
+	}
+	return fmt.Errorf("unknown conflict policy %q, use one of %s", value, strings.Join(names, ", "))
+}
+
+// differsReason returns why a file of size bytes modified at modTime
+// differs from the existing remote file, or "" when it does not. Remote
+// times newer than the local one are not a difference, files uploaded
+// before modification times were kept carry their upload time.
+func differsReason(size int64, modTime time.Time, existing types.FileInfo) string {
+	if size != existing.Size {
+		return fmt.Sprintf("size %d != %d", size, existing.Size)
+	}
+	if modTime.After(existing.ModTime.Add(modTimeWindow)) {
+		return "newer modtime"
+	}
+	return ""
+}
+
+// conflictName returns the first of "name (1).ext", "name (2).ext", ...
+// which taken reports as free
+func conflictName(name string, taken func(name string) (bool, error)) (string, error) {
+	ext := path.Ext(name)
+	if ext == name {
+		// dot files such as .env have no extension
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		exists, err := taken(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+	}
+}
+
+// conflict is how an upload onto an existing remote file is resolved
+type conflict struct {
+	// name is the local name to upload the file as
+	name string
+	// replace is the existing entry removed for the new file
+	replace *types.FileInfo
+	// skip is why the file is not uploaded, "" when it is
+	skip string
+	// reason describes the resolution in logs and reports
+	reason string
+}
+
+// resolveConflict applies policy to the local file name, whose remote name
+// in destDir is taken by existing. size is the size the file has on the
+// server.
+func (u *UploadService) resolveConflict(policy ConflictPolicy, name string, destDir string, size int64, modTime time.Time, existing *types.FileInfo) (conflict, error) {
+	switch policy {
+	case ConflictOverwrite, ConflictUpdate:
+		if existing.Type == "folder" {
+			return conflict{}, fmt.Errorf("%s is a directory", path.Join(destDir, name))
+		}
+		if policy == ConflictOverwrite {
+			return conflict{name: name, replace: existing, reason: "overwrite"}, nil
+		}
+		reason := differsReason(size, modTime, *existing)
+		if reason == "" {
+			return conflict{skip: "unchanged"}, nil
+		}
+		return conflict{name: name, replace: existing, reason: "update, " + reason}, nil
+	case ConflictRename:
+		newName, err := conflictName(name, func(candidate string) (bool, error) {
+			file, err := u.findFile(u.remoteFileName(candidate), destDir)
+			return file != nil, err
+		})
+		if err != nil {
+			return conflict{}, err
+		}
+		return conflict{name: newName, reason: "rename"}, nil
+	default:
+		return conflict{skip: "exists"}, nil
+	}
+}
+
+// createName returns the name a file uploaded as name is created under.
+// A file replacing another one is created under a temporary name, so the
+// old file is kept when the new one cannot be created.
+func createName(name string, uploadID string, replace *types.FileInfo) string {
+	if replace == nil {
+		return name
+	}
+	return fmt.Sprintf("%s.%.8s.partial", name, uploadID)
+}
+
+// replaceFile deletes the remote file replaced by created, when there is
+// one, and gives created its name. Once created exists this runs to the end
+// even when the transfer is cancelled, so no temporary file is left behind.
+func (u *UploadService) replaceFile(replace *types.FileInfo, created *types.FileInfo, name string) error {
+	if replace == nil {
+		return nil
+	}
+	if err := u.finish.Delete(replace.Id); err != nil {
+		return fmt.Errorf("delete replaced file failed, new file kept as %s: %w", created.Name, err)
+	}
+	if err := u.finish.Rename(created, name); err != nil {
+		return fmt.Errorf("rename new file failed, it is kept as %s: %w", created.Name, err)
+	}
+	created.Name = name
+	return nil
+}
@@ -0,0 +1,357 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"uploader/pkg/types"
+
+	"github.com/rclone/rclone/fs"
+	"go.uber.org/zap"
+)
+
+type CopyOp string
+
+const (
+	CopyMkdir  CopyOp = "mkdir"
+	CopyFile   CopyOp = "copy"
+	CopyMove   CopyOp = "move"
+	CopyDelete CopyOp = "delete"
+	CopySkip   CopyOp = "skip"
+	CopyRmdir  CopyOp = "rmdir"
+)
+
+// CopyAction is a single step of a server side copy or move
+type CopyAction struct {
+	Op     CopyOp
+	Src    string
+	Dst    string
+	Reason string
+	// info is the source entry, or the destination entry being replaced
+	info *types.FileInfo
+}
+
+func (a CopyAction) String() string {
+	var s string
+	switch a.Op {
+	case CopyMkdir, CopyDelete:
+		s = fmt.Sprintf("%-6s %s", a.Op, a.Dst)
+	case CopyRmdir:
+		s = fmt.Sprintf("%-6s %s", a.Op, a.Src)
+	default:
+		s = fmt.Sprintf("%-6s %s -> %s", a.Op, a.Src, a.Dst)
+	}
+	if a.Reason != "" {
+		s += " (" + a.Reason + ")"
+	}
+	return s
+}
+
+// CopyService copies or moves remote files and folders through the API,
+// without downloading anything
+type CopyService struct {
+	files      *FileService
+	logger     *zap.Logger
+	move       bool
+	onConflict ConflictPolicy
+	results    transferResults
+}
+
+// NewCopyService returns a CopyService which moves entries when move is set
+// and copies them otherwise. Existing destination files are handled as
+// onConflict says, existing folders are merged.
+func NewCopyService(files *FileService, logger *zap.Logger, move bool, onConflict ConflictPolicy) *CopyService {
+	return &CopyService{
+		files:      files,
+		logger:     logger,
+		move:       move,
+		onConflict: onConflict,
+	}
+}
+
+func (c *CopyService) verb() string {
+	if c.move {
+		return "move"
+	}
+	return "copy"
+}
+
+// stat returns the entry at remotePath, or nil when there is none
+func (c *CopyService) stat(remotePath string) (*types.FileInfo, error) {
+	info, err := c.files.Stat(remotePath)
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("stat %s failed: %w", remotePath, err)
+	}
+	return info, nil
+}
+
+// Plan returns the actions copying or moving src to dst. When dst is an
+// existing folder src is placed inside it, like cp(1) and mv(1), and
+// folders are merged into existing destination folders.
+func (c *CopyService) Plan(src string, dst string) ([]CopyAction, error) {
+	src, dst = CleanPath(src), CleanPath(dst)
+	if src == "/" {
+		return nil, fmt.Errorf("refusing to %s the root directory", c.verb())
+	}
+
+	info, err := c.stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, fmt.Errorf("%s not found", src)
+	}
+
+	target := dst
+	targetInfo, err := c.stat(dst)
+	if err != nil {
+		return nil, err
+	}
+	if targetInfo != nil && targetInfo.Type == "folder" {
+		target = path.Join(dst, info.Name)
+		if targetInfo, err = c.stat(target); err != nil {
+			return nil, err
+		}
+	}
+
+	if target == src {
+		return nil, fmt.Errorf("%s and %s are the same", src, target)
+	}
+	if strings.HasPrefix(target, src+"/") {
+		return nil, fmt.Errorf("cannot %s %s into itself", c.verb(), src)
+	}
+
+	var actions []CopyAction
+	if targetInfo == nil {
+		parent, err := c.stat(path.Dir(target))
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case parent == nil:
+			actions = append(actions, CopyAction{Op: CopyMkdir, Dst: path.Dir(target)})
+		case parent.Type != "folder":
+			return nil, fmt.Errorf("%s is not a directory", path.Dir(target))
+		}
+	}
+
+	taken := func(name string) (bool, error) {
+		file, err := c.stat(path.Join(path.Dir(target), name))
+		return file != nil, err
+	}
+	planned, err := c.plan(src, *info, target, targetInfo, taken)
+	if err != nil {
+		return nil, err
+	}
+	return append(actions, planned...), nil
+}
+
+// plan returns the actions for the source entry src at srcPath, whose
+// destination dstPath holds dst or nothing when dst is nil. taken tells
+// whether a name next to dstPath is in use, for renamed entries.
+func (c *CopyService) plan(srcPath string, src types.FileInfo, dstPath string, dst *types.FileInfo, taken func(name string) (bool, error)) ([]CopyAction, error) {
+	op := CopyFile
+	if c.move {
+		op = CopyMove
+	}
+
+	switch {
+	case dst == nil && src.Type == "folder" && !c.move:
+		actions := []CopyAction{{Op: CopyMkdir, Dst: dstPath}}
+		children, err := c.planChildren(srcPath, dstPath, false)
+		if err != nil {
+			return nil, err
+		}
+		return append(actions, children...), nil
+	case dst == nil:
+		// a folder is moved with its contents in one request
+		return []CopyAction{{Op: op, Src: srcPath, Dst: dstPath, info: &src}}, nil
+	case src.Type == "folder" && dst.Type == "folder":
+		actions, err := c.planChildren(srcPath, dstPath, true)
+		if err != nil {
+			return nil, err
+		}
+		if c.move {
+			actions = append(actions, CopyAction{Op: CopyRmdir, Src: srcPath, Reason: "if empty"})
+		}
+		return actions, nil
+	case c.onConflict == ConflictRename:
+		name, err := conflictName(path.Base(dstPath), taken)
+		if err != nil {
+			return nil, err
+		}
+		actions, err := c.plan(srcPath, src, path.Join(path.Dir(dstPath), name), nil, taken)
+		if err != nil {
+			return nil, err
+		}
+		actions[0].Reason = "renamed"
+		return actions, nil
+	case src.Type != dst.Type:
+		return []CopyAction{{Op: CopySkip, Src: srcPath, Dst: dstPath, Reason: "destination is a " + dst.Type}}, nil
+	case c.onConflict == ConflictOverwrite:
+		return []CopyAction{
+			{Op: CopyDelete, Dst: dstPath, Reason: "overwritten", info: dst},
+			{Op: op, Src: srcPath, Dst: dstPath, info: &src},
+		}, nil
+	case c.onConflict == ConflictUpdate:
+		reason := differsReason(src.Size, src.ModTime, *dst)
+		if reason == "" {
+			return []CopyAction{{Op: CopySkip, Src: srcPath, Dst: dstPath, Reason: "unchanged"}}, nil
+		}
+		return []CopyAction{
+			{Op: CopyDelete, Dst: dstPath, Reason: "updated", info: dst},
+			{Op: op, Src: srcPath, Dst: dstPath, Reason: reason, info: &src},
+		}, nil
+	default:
+		return []CopyAction{{Op: CopySkip, Src: srcPath, Dst: dstPath, Reason: "exists"}}, nil
+	}
+}
+
+// planChildren plans the contents of the folder srcPath into dstPath,
+// which is listed for conflicts when it exists
+func (c *CopyService) planChildren(srcPath string, dstPath string, dstExists bool) ([]CopyAction, error) {
+	children, err := c.files.List(srcPath)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]types.FileInfo)
+	if dstExists {
+		files, err := c.files.List(dstPath)
+		if err != nil && !errors.Is(err, fs.ErrorDirNotFound) {
+			return nil, err
+		}
+		for _, file := range files {
+			existing[file.Name] = file
+		}
+	}
+
+	// renamed entries must not take the name of another entry, existing or
+	// still to be copied
+	reserved := make(map[string]bool)
+	for _, child := range children {
+		reserved[child.Name] = true
+	}
+	taken := func(name string) (bool, error) {
+		_, exists := existing[name]
+		if exists || reserved[name] {
+			return true, nil
+		}
+		reserved[name] = true
+		return false, nil
+	}
+
+	var actions []CopyAction
+	for _, child := range children {
+		var dst *types.FileInfo
+		if file, ok := existing[child.Name]; ok {
+			dst = &file
+		}
+		childActions, err := c.plan(path.Join(srcPath, child.Name), child, path.Join(dstPath, child.Name), dst, taken)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, childActions...)
+	}
+	return actions, nil
+}
+
+// Report writes every planned action to w
+func (c *CopyService) Report(w io.Writer, actions []CopyAction) {
+	for _, action := range actions {
+		fmt.Fprintln(w, action.String())
+	}
+}
+
+// Execute applies the planned actions in order. Failed actions do not stop
+// the others and are returned as a *TransferError.
+func (c *CopyService) Execute(actions []CopyAction) error {
+	// a destination which could not be removed is not written over
+	notRemoved := make(map[string]bool)
+
+	for _, action := range actions {
+		if err := c.files.ctx.Err(); err != nil {
+			return err
+		}
+		if action.Op == CopySkip {
+			c.logger.Info("skipping", zap.String("action", action.String()))
+			continue
+		}
+
+		c.logger.Info(c.verb(), zap.String("action", action.String()))
+
+		var err error
+		switch action.Op {
+		case CopyMkdir:
+			err = c.files.Mkdir(action.Dst)
+		case CopyDelete:
+			err = c.files.Delete(action.info.Id)
+			if err != nil {
+				notRemoved[action.Dst] = true
+			}
+		case CopyFile:
+			if notRemoved[action.Dst] {
+				err = errors.New("destination could not be removed")
+			} else {
+				err = c.files.Copy(action.info, path.Dir(action.Dst), path.Base(action.Dst))
+			}
+		case CopyMove:
+			if notRemoved[action.Dst] {
+				err = errors.New("destination could not be removed")
+			} else {
+				err = c.moveEntry(action)
+			}
+		case CopyRmdir:
+			err = c.removeIfEmpty(action.Src)
+		}
+
+		name := action.Src
+		if name == "" {
+			name = action.Dst
+		}
+		if err != nil {
+			c.logger.Error(c.verb()+" failed", zap.String("action", action.String()), zap.Error(err))
+		}
+		c.results.record(name, err)
+	}
+
+	return c.results.err()
+}
+
+// moveEntry moves the source of action into the folder of its destination
+// and renames it when the name differs
+func (c *CopyService) moveEntry(action CopyAction) error {
+	destDir, destName := path.Dir(action.Dst), path.Base(action.Dst)
+	if path.Dir(action.Src) != destDir {
+		if err := c.files.Move(destDir, action.info.Id); err != nil {
+			return err
+		}
+	}
+	if action.info.Name != destName {
+		return c.files.Rename(action.info, destName)
+	}
+	return nil
+}
+
+// removeIfEmpty deletes the folder at remotePath once a merge moved
+// everything out of it. Skipped entries keep it in place.
+func (c *CopyService) removeIfEmpty(remotePath string) error {
+	info, err := c.files.Stat(remotePath)
+	if err != nil {
+		return err
+	}
+	children, err := c.files.List(remotePath)
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		c.logger.Info("keeping source directory", zap.String("path", remotePath), zap.Int("remaining", len(children)))
+		return nil
+	}
+	return c.files.Delete(info.Id)
+}
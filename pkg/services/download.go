@@ -0,0 +1,419 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"uploader/pkg/crypt"
+	"uploader/pkg/pb"
+	"uploader/pkg/report"
+	"uploader/pkg/types"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/rest"
+	"go.uber.org/zap"
+)
+
+type DownloadService struct {
+	http            *rest.Client
+	numWorkers      int
+	concurrentFiles chan struct{}
+	partSize        int64
+	pacer           *fs.Pacer
+	ctx             context.Context
+	Progress        *pb.Progress
+	wg              *sync.WaitGroup
+	logger          *zap.Logger
+	isDryRun        bool
+	files           *FileService
+	reporter        *report.Reporter
+	cipher          *crypt.Cipher
+	results         transferResults
+}
+
+func NewDownloadService(
+	http *rest.Client,
+	numWorkers int,
+	numTransfers int,
+	partSize int64,
+	pacer *fs.Pacer,
+	ctx context.Context,
+	progress *pb.Progress,
+	wg *sync.WaitGroup,
+	logger *zap.Logger,
+	isDryRun bool,
+	reporter *report.Reporter,
+	cipher *crypt.Cipher,
+) *DownloadService {
+	return &DownloadService{
+		http:            http,
+		numWorkers:      numWorkers,
+		concurrentFiles: make(chan struct{}, numTransfers),
+		partSize:        partSize,
+		pacer:           pacer,
+		ctx:             ctx,
+		Progress:        progress,
+		wg:              wg,
+		logger:          logger,
+		isDryRun:        isDryRun,
+		files:           NewFileService(http, pacer, ctx, logger),
+		reporter:        reporter,
+		cipher:          cipher,
+	}
+}
+
+// Stat returns the remote file or folder at remotePath. With client side
+// encryption the last element may also be given by its original name.
+func (d *DownloadService) Stat(remotePath string) (*types.FileInfo, error) {
+	return d.files.StatCrypt(remotePath, d.cipher)
+}
+
+// LocalName returns the name and size the remote file info has once
+// downloaded, which differ from the remote ones with client side encryption
+func (d *DownloadService) LocalName(info types.FileInfo) (string, int64, error) {
+	if d.cipher == nil {
+		return info.Name, info.Size, nil
+	}
+	name, err := d.cipher.DecryptFileName(info.Name)
+	if err != nil {
+		return "", 0, err
+	}
+	size, err := d.cipher.DecryptedSize(info.Size)
+	if err != nil {
+		return "", 0, err
+	}
+	return name, size, nil
+}
+
+// localFileExists reports whether localPath already holds a file of the given size
+func localFileExists(localPath string, size int64) bool {
+	info, err := os.Stat(localPath)
+	return err == nil && !info.IsDir() && info.Size() == size
+}
+
+// DownloadFile downloads the remote file info, found at remotePath, to localPath
+func (d *DownloadService) DownloadFile(info types.FileInfo, remotePath string, localPath string) (err error) {
+	defer func() {
+		if err != nil {
+			d.reporter.FileFailed(localPath, err)
+		}
+	}()
+
+	_, fileSize, err := d.LocalName(info)
+	if err != nil {
+		return err
+	}
+
+	bar := newTransferBar(filepath.Base(localPath), fileSize)
+	defer bar.Close()
+
+	d.Progress.AddBar(bar)
+
+	d.reporter.FileStarted(localPath, remotePath, fileSize)
+
+	if localFileExists(localPath, fileSize) {
+		d.logger.Info("file exists", zap.String("localPath", localPath))
+		d.reporter.FileSkipped(localPath, "exists")
+		return nil
+	}
+
+	if d.isDryRun {
+		d.logger.Info("dry run mode enabled, skipping download", zap.String("fileName", info.Name))
+		d.reporter.FileSkipped(localPath, "dry run")
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		bar.Abort()
+		return err
+	}
+
+	var nonce crypt.Nonce
+	if d.cipher != nil {
+		nonce, err = d.readNonce(info)
+		if err != nil {
+			bar.Abort()
+			d.logger.Error("read encryption header failed", zap.String("fileName", info.Name), zap.Error(err))
+			return err
+		}
+	}
+
+	partialPath := localPath + ".partial"
+	file, err := os.OpenFile(partialPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		bar.Abort()
+		d.logger.Error("create file failed", zap.String("partialPath", partialPath), zap.Error(err))
+		return err
+	}
+
+	totalParts := fileSize / d.partSize
+	if fileSize%d.partSize != 0 {
+		totalParts++
+	}
+
+	var (
+		wg                sync.WaitGroup
+		mu                sync.Mutex
+		downloadErr       error
+		concurrentWorkers = make(chan struct{}, d.numWorkers)
+	)
+
+queueParts:
+	for i := int64(0); i < totalParts; i++ {
+		start := i * d.partSize
+		end := start + d.partSize
+		if end > fileSize {
+			end = fileSize
+		}
+
+		select {
+		case concurrentWorkers <- struct{}{}:
+		case <-d.ctx.Done():
+			mu.Lock()
+			if downloadErr == nil {
+				downloadErr = d.ctx.Err()
+			}
+			mu.Unlock()
+			break queueParts
+		}
+		wg.Add(1)
+
+		go func(partNumber int64, start, end int64) {
+			defer wg.Done()
+			defer func() {
+				<-concurrentWorkers
+			}()
+
+			err := d.downloadPart(info, file, bar, nonce, start, end)
+			if err == nil {
+				d.reporter.PartDone(localPath, int(partNumber)+1, int(totalParts), end-start)
+			}
+			if err != nil {
+				d.logger.Error("download part failed", zap.String("fileName", info.Name), zap.Int64("partNumber", partNumber+1), zap.Int64("totalParts", totalParts), zap.Error(err))
+				mu.Lock()
+				if downloadErr == nil {
+					downloadErr = err
+				}
+				mu.Unlock()
+			}
+		}(i, start, end)
+	}
+
+	wg.Wait()
+
+	if err := file.Close(); err != nil && downloadErr == nil {
+		downloadErr = err
+	}
+
+	if downloadErr != nil {
+		bar.Abort()
+		os.Remove(partialPath)
+		return downloadErr
+	}
+
+	if err := os.Rename(partialPath, localPath); err != nil {
+		bar.Abort()
+		return err
+	}
+
+	if !info.ModTime.IsZero() {
+		if err := os.Chtimes(localPath, info.ModTime, info.ModTime); err != nil {
+			d.logger.Warn("set modtime failed", zap.String("localPath", localPath), zap.Error(err))
+		}
+	}
+
+	bar.Finish()
+
+	d.logger.Info("file received", zap.String("fileName", info.Name), zap.Int64("fileSize", fileSize))
+	d.reporter.FileDone(localPath, info.Id)
+
+	return nil
+}
+
+// rangeOpts returns the request for length bytes of the remote file from offset
+func rangeOpts(info types.FileInfo, offset, length int64) rest.Opts {
+	return rest.Opts{
+		Method: "GET",
+		Path:   fmt.Sprintf("/api/files/%s/%s", info.Id, url.PathEscape(info.Name)),
+		ExtraHeaders: map[string]string{
+			"Range": fmt.Sprintf("bytes=%d-%d", offset, offset+length-1),
+		},
+	}
+}
+
+// readNonce fetches the header of the client side encrypted remote file
+func (d *DownloadService) readNonce(info types.FileInfo) (nonce crypt.Nonce, err error) {
+	opts := rangeOpts(info, 0, crypt.HeaderSize())
+
+	err = d.pacer.Call(func() (bool, error) {
+		resp, err := d.http.Call(d.ctx, &opts)
+		if err != nil {
+			return ShouldRetry(d.ctx, resp, err)
+		}
+		defer resp.Body.Close()
+
+		nonce, err = crypt.ReadNonce(resp.Body)
+		if errors.Is(err, crypt.ErrBadMagic) {
+			return false, err
+		}
+		return ShouldRetry(d.ctx, resp, err)
+	})
+	return nonce, err
+}
+
+// downloadPart fetches the byte range [start, end) of the remote file and
+// writes it at the same offset of file. With client side encryption the
+// range is of the decrypted file and the blocks holding it are fetched.
+func (d *DownloadService) downloadPart(info types.FileInfo, file *os.File, bar *pb.Bar, nonce crypt.Nonce, start, end int64) error {
+	fetchStart, fetchLength := start, end-start
+	if d.cipher != nil {
+		fetchStart, fetchLength = d.cipher.CipherRange(start, end-start, info.Size)
+	}
+	opts := rangeOpts(info, fetchStart, fetchLength)
+
+	return d.pacer.Call(func() (bool, error) {
+		resp, err := d.http.Call(d.ctx, &opts)
+		if err != nil {
+			return ShouldRetry(d.ctx, resp, err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusPartialContent && (fetchStart != 0 || fetchLength != info.Size) {
+			return false, fmt.Errorf("range request not supported, got status %d", resp.StatusCode)
+		}
+
+		body := io.LimitReader(resp.Body, fetchLength)
+		if d.cipher != nil {
+			body = d.cipher.DecryptRange(body, nonce, start, end-start)
+		}
+
+		w := io.NewOffsetWriter(file, start)
+		n, err := io.Copy(w, bar.ProxyReader(body))
+		if errors.Is(err, crypt.ErrBadBlock) {
+			bar.IncrInt64(-n)
+			return false, err
+		}
+		if err == nil && n != end-start {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			// rewind so a retried part is not counted twice
+			bar.IncrInt64(-n)
+			return ShouldRetry(d.ctx, resp, err)
+		}
+		return false, nil
+	})
+}
+
+func (d *DownloadService) DownloadFilesInDirectory(remotePath string, localDir string) error {
+	entries, err := d.files.List(remotePath)
+	if err != nil {
+		d.logger.Error("list remote dir failed", zap.String("remotePath", remotePath), zap.Error(err))
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := d.ctx.Err(); err != nil {
+			return err
+		}
+
+		name := entry.Name
+		if entry.Type != "folder" {
+			name, _, err = d.LocalName(entry)
+			if err != nil {
+				d.logger.Warn("skipping file which is not encrypted", zap.String("remotePath", path.Join(remotePath, entry.Name)), zap.Error(err))
+				continue
+			}
+		}
+		fullPath := filepath.Join(localDir, name)
+
+		if entry.Type == "folder" {
+			subDir := path.Join(remotePath, entry.Name)
+			if !d.isDryRun {
+				if err := os.MkdirAll(fullPath, 0755); err != nil {
+					d.logger.Error("create local dir failed", zap.String("fullPath", fullPath), zap.Error(err))
+					d.results.record(subDir, err)
+					continue
+				}
+			}
+			err = d.DownloadFilesInDirectory(subDir, fullPath)
+			if d.ctx.Err() != nil {
+				return d.ctx.Err()
+			}
+			if err != nil {
+				d.logger.Error("download files in directory failed", zap.String("subDir", subDir), zap.String("fullPath", fullPath), zap.Error(err))
+				d.results.record(subDir, err)
+				continue
+			}
+		} else {
+			select {
+			case d.concurrentFiles <- struct{}{}:
+			case <-d.ctx.Done():
+				return d.ctx.Err()
+			}
+			d.wg.Add(1)
+
+			go func(entry types.FileInfo) {
+				defer d.wg.Done()
+				defer func() {
+					<-d.concurrentFiles
+				}()
+
+				err := d.DownloadFile(entry, path.Join(remotePath, entry.Name), fullPath)
+				d.results.record(fullPath, err)
+				if errors.Is(err, context.Canceled) {
+					d.logger.Info("download cancelled", zap.String("fullPath", fullPath))
+					return
+				}
+				if err != nil {
+					d.logger.Error("download failed", zap.String("fullPath", fullPath), zap.Error(err))
+				}
+			}(entry)
+		}
+	}
+
+	return nil
+}
+
+// Err returns a *TransferError listing every file which failed to download,
+// or nil when all of them were downloaded. Call it once Progress.Wait returned.
+func (d *DownloadService) Err() error {
+	return d.results.err()
+}
+
+func (d *DownloadService) GetFilesInDirectoryInfo(remotePath string) (FileInfo, error) {
+	entries, err := d.files.List(remotePath)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	var info FileInfo
+
+	for _, entry := range entries {
+		if entry.Type == "folder" {
+			subInfo, err := d.GetFilesInDirectoryInfo(path.Join(remotePath, entry.Name))
+			if err != nil {
+				return FileInfo{}, err
+			}
+
+			info.TotalFiles += subInfo.TotalFiles
+			info.TotalSize += subInfo.TotalSize
+		} else {
+			_, size, err := d.LocalName(entry)
+			if err != nil {
+				continue
+			}
+			info.TotalFiles++
+			info.TotalSize += size
+		}
+	}
+
+	return info, nil
+}
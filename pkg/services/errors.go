@@ -0,0 +1,70 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FileError is the failure of a single file or directory transfer
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// TransferError holds every transfer which failed out of Total
+type TransferError struct {
+	Failed []*FileError
+	Total  int
+}
+
+func (e *TransferError) Error() string {
+	return fmt.Sprintf("%d of %d transfers failed, first error: %v", len(e.Failed), e.Total, e.Failed[0])
+}
+
+func (e *TransferError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, err := range e.Failed {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Partial reports whether some transfers succeeded
+func (e *TransferError) Partial() bool {
+	return len(e.Failed) < e.Total
+}
+
+// transferResults collects the outcome of transfers run in goroutines
+type transferResults struct {
+	mu     sync.Mutex
+	total  int
+	failed []*FileError
+}
+
+// record counts the transfer of path, failed when err is set
+func (r *transferResults) record(path string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total++
+	if err != nil {
+		r.failed = append(r.failed, &FileError{Path: path, Err: err})
+	}
+}
+
+// err returns a *TransferError when any transfer failed, nil otherwise
+func (r *transferResults) err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.failed) == 0 {
+		return nil
+	}
+	return &TransferError{Failed: append([]*FileError(nil), r.failed...), Total: r.total}
+}
@@ -0,0 +1,276 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+	"uploader/pkg/crypt"
+	"uploader/pkg/types"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/rest"
+	"go.uber.org/zap"
+)
+
+const listPageLimit = 500
+
+type FileService struct {
+	http   *rest.Client
+	pacer  *fs.Pacer
+	ctx    context.Context
+	logger *zap.Logger
+}
+
+func NewFileService(
+	http *rest.Client,
+	pacer *fs.Pacer,
+	ctx context.Context,
+	logger *zap.Logger,
+) *FileService {
+	return &FileService{
+		http:   http,
+		pacer:  pacer,
+		ctx:    ctx,
+		logger: logger,
+	}
+}
+
+// CleanPath returns remotePath as an absolute slash separated path
+func CleanPath(remotePath string) string {
+	return path.Clean("/" + remotePath)
+}
+
+// Stat returns the file or folder at remotePath, or fs.ErrorObjectNotFound
+func (f *FileService) Stat(remotePath string) (*types.FileInfo, error) {
+	remotePath = CleanPath(remotePath)
+	if remotePath == "/" {
+		return &types.FileInfo{Name: "/", Type: "folder"}, nil
+	}
+
+	opts := rest.Opts{
+		Method: "GET",
+		Path:   "/api/files",
+		Parameters: url.Values{
+			"path":      []string{path.Dir(remotePath)},
+			"name":      []string{path.Base(remotePath)},
+			"operation": []string{"find"},
+		},
+	}
+
+	var (
+		info types.ReadMetadataResponse
+		resp *http.Response
+		err  error
+	)
+
+	err = f.pacer.Call(func() (bool, error) {
+		resp, err = f.http.CallJSON(f.ctx, &opts, nil, &info)
+		return ShouldRetry(f.ctx, resp, err)
+	})
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, fs.ErrorObjectNotFound
+		}
+		return nil, err
+	}
+	if len(info.Files) == 0 {
+		return nil, fs.ErrorObjectNotFound
+	}
+
+	return &info.Files[0], nil
+}
+
+// StatCrypt is Stat for a remotePath whose last element may also be given
+// by its original name when file names are encrypted with cipher, the name
+// ls and download show
+func (f *FileService) StatCrypt(remotePath string, cipher *crypt.Cipher) (*types.FileInfo, error) {
+	info, err := f.Stat(remotePath)
+	if errors.Is(err, fs.ErrorObjectNotFound) && cipher != nil {
+		remotePath = CleanPath(remotePath)
+		return f.Stat(path.Join(path.Dir(remotePath), cipher.EncryptFileName(path.Base(remotePath))))
+	}
+	return info, err
+}
+
+// List returns the contents of the folder at remotePath
+func (f *FileService) List(remotePath string) ([]types.FileInfo, error) {
+	remotePath = CleanPath(remotePath)
+
+	var files []types.FileInfo
+
+	for page := 1; ; page++ {
+		opts := rest.Opts{
+			Method: "GET",
+			Path:   "/api/files",
+			Parameters: url.Values{
+				"path":      []string{remotePath},
+				"operation": []string{"list"},
+				"page":      []string{strconv.Itoa(page)},
+				"limit":     []string{strconv.Itoa(listPageLimit)},
+			},
+		}
+
+		var (
+			info types.ReadMetadataResponse
+			resp *http.Response
+			err  error
+		)
+
+		err = f.pacer.Call(func() (bool, error) {
+			resp, err = f.http.CallJSON(f.ctx, &opts, nil, &info)
+			return ShouldRetry(f.ctx, resp, err)
+		})
+		if err != nil {
+			if resp != nil && resp.StatusCode == http.StatusNotFound {
+				return nil, fs.ErrorDirNotFound
+			}
+			return nil, err
+		}
+
+		files = append(files, info.Files...)
+
+		if len(info.Files) < listPageLimit || info.Meta.CurrentPage >= info.Meta.TotalPages {
+			break
+		}
+	}
+
+	f.logger.Debug("listed remote dir", zap.String("path", remotePath), zap.Int("count", len(files)))
+
+	return files, nil
+}
+
+// Mkdir creates the folder at remotePath along with any missing parents
+func (f *FileService) Mkdir(remotePath string) error {
+	_, err := f.mkdir(remotePath)
+	return err
+}
+
+// mkdir is Mkdir returning the folder created, or nil when the server did
+// not send it back
+func (f *FileService) mkdir(remotePath string) (*types.FileInfo, error) {
+	opts := rest.Opts{
+		Method: "POST",
+		Path:   "/api/files/mkdir",
+	}
+
+	mkdir := types.CreateFileRequest{
+		Path: CleanPath(remotePath),
+	}
+
+	var created types.FileInfo
+	err := f.pacer.Call(func() (bool, error) {
+		created = types.FileInfo{}
+		resp, err := f.http.CallJSON(f.ctx, &opts, &mkdir, &created)
+		if err == io.EOF && resp != nil && resp.StatusCode < 300 {
+			// an empty body
+			return false, nil
+		}
+		return ShouldRetry(f.ctx, resp, err)
+	})
+	if err != nil || created.Id == "" {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// Delete removes the files or folders with the given ids, folders are
+// removed together with their contents
+func (f *FileService) Delete(ids ...string) error {
+	opts := rest.Opts{
+		Method:     "POST",
+		Path:       "/api/files/delete",
+		NoResponse: true,
+	}
+
+	request := types.DeleteFilesRequest{
+		Files: ids,
+	}
+
+	return f.pacer.Call(func() (bool, error) {
+		resp, err := f.http.CallJSON(f.ctx, &opts, &request, nil)
+		return ShouldRetry(f.ctx, resp, err)
+	})
+}
+
+// Move moves the files or folders with the given ids into the folder destDir
+func (f *FileService) Move(destDir string, ids ...string) error {
+	opts := rest.Opts{
+		Method:     "POST",
+		Path:       "/api/files/move",
+		NoResponse: true,
+	}
+
+	request := types.MoveFilesRequest{
+		Files:       ids,
+		Destination: CleanPath(destDir),
+	}
+
+	return f.pacer.Call(func() (bool, error) {
+		resp, err := f.http.CallJSON(f.ctx, &opts, &request, nil)
+		return ShouldRetry(f.ctx, resp, err)
+	})
+}
+
+// Copy copies the file info into the folder destDir as name. Teldrive
+// copies the parts itself, nothing is downloaded.
+func (f *FileService) Copy(info *types.FileInfo, destDir string, name string) error {
+	opts := rest.Opts{
+		Method:     "POST",
+		Path:       "/api/files/" + info.Id + "/copy",
+		NoResponse: true,
+	}
+
+	request := types.CopyFileRequest{
+		NewName:     name,
+		Destination: CleanPath(destDir),
+	}
+
+	return f.pacer.Call(func() (bool, error) {
+		resp, err := f.http.CallJSON(f.ctx, &opts, &request, nil)
+		return ShouldRetry(f.ctx, resp, err)
+	})
+}
+
+// SetModTime sets the modification time of the file or folder info
+func (f *FileService) SetModTime(info *types.FileInfo, modTime time.Time) error {
+	opts := rest.Opts{
+		Method:     "PATCH",
+		Path:       "/api/files/" + info.Id,
+		NoResponse: true,
+	}
+
+	modTime = modTime.UTC()
+	request := types.UpdateFileRequest{
+		Type:    info.Type,
+		ModTime: &modTime,
+	}
+
+	return f.pacer.Call(func() (bool, error) {
+		resp, err := f.http.CallJSON(f.ctx, &opts, &request, nil)
+		return ShouldRetry(f.ctx, resp, err)
+	})
+}
+
+// Rename changes the name of the file or folder info in place
+func (f *FileService) Rename(info *types.FileInfo, name string) error {
+	opts := rest.Opts{
+		Method:     "PATCH",
+		Path:       "/api/files/" + info.Id,
+		NoResponse: true,
+	}
+
+	request := types.UpdateFileRequest{
+		Name: name,
+		Type: info.Type,
+	}
+
+	return f.pacer.Call(func() (bool, error) {
+		resp, err := f.http.CallJSON(f.ctx, &opts, &request, nil)
+		return ShouldRetry(f.ctx, resp, err)
+	})
+}
@@ -0,0 +1,28 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/rclone/rclone/fs/filter"
+)
+
+// includeFile reports whether the local file at rel, relative to the root of
+// the transfer, passes fileFilter. A nil filter includes everything.
+func includeFile(fileFilter *filter.Filter, rel string, info os.FileInfo) bool {
+	if fileFilter == nil {
+		return true
+	}
+	return fileFilter.Include(filepath.ToSlash(rel), info.Size(), info.ModTime(), nil)
+}
+
+// includeDir reports whether the local directory at rel should be descended into
+func includeDir(fileFilter *filter.Filter, rel string) bool {
+	if fileFilter == nil {
+		return true
+	}
+	// no exclude-if-present files are used, so no remote is needed
+	include, err := fileFilter.IncludeDirectory(context.Background(), nil)(filepath.ToSlash(rel))
+	return err != nil || include
+}
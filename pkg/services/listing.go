@@ -0,0 +1,83 @@
+package services
+
+import (
+	"errors"
+	"path"
+	"time"
+	"uploader/pkg/types"
+
+	"github.com/rclone/rclone/fs"
+	"go.uber.org/zap"
+)
+
+// listDir lists the remote folder destDir once, so the files uploaded to
+// it are checked against the listing instead of being looked up one by one.
+// The ids of the folder and its subfolders go to the directory cache.
+func (u *UploadService) listDir(destDir string) error {
+	destDir = CleanPath(destDir)
+
+	u.listingsMu.Lock()
+	_, ok := u.listings[destDir]
+	u.listingsMu.Unlock()
+	if ok {
+		return nil
+	}
+
+	files, err := u.remote.List(destDir)
+	if errors.Is(err, fs.ErrorDirNotFound) && u.isDryRun {
+		// dry runs do not create the folders they would upload to
+		files, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	listing := make(map[string]types.FileInfo, len(files))
+	for _, file := range files {
+		listing[file.Name] = file
+		if file.Type == "folder" {
+			u.dirs.Put(path.Join(destDir, file.Name), file.Id)
+		}
+		if file.ParentId != "" {
+			u.dirs.Put(destDir, file.ParentId)
+		}
+	}
+	u.logger.Debug("listed remote dir", zap.String("destDir", destDir), zap.Int("entries", len(listing)))
+
+	u.listingsMu.Lock()
+	u.listings[destDir] = listing
+	u.listingsMu.Unlock()
+	return nil
+}
+
+// listed returns the entry called name in destDir, or nil when there is
+// none. ok is false when destDir was not listed.
+func (u *UploadService) listed(destDir string, name string) (info *types.FileInfo, ok bool) {
+	u.listingsMu.Lock()
+	defer u.listingsMu.Unlock()
+	listing, ok := u.listings[CleanPath(destDir)]
+	if !ok {
+		return nil, false
+	}
+	if file, found := listing[name]; found {
+		return &file, true
+	}
+	return nil, true
+}
+
+// updateListing records file as the entry called name in destDir, when
+// destDir was listed
+func (u *UploadService) updateListing(destDir string, name string, file *types.FileInfo) {
+	u.listingsMu.Lock()
+	defer u.listingsMu.Unlock()
+	if listing, ok := u.listings[CleanPath(destDir)]; ok {
+		listing[name] = *file
+	}
+}
+
+// sameModTime reports whether two modification times are equal within the
+// precision kept by the server
+func sameModTime(a time.Time, b time.Time) bool {
+	d := a.Sub(b)
+	return d < modTimeWindow && d > -modTimeWindow
+}
@@ -0,0 +1,308 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"uploader/pkg/types"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// memoryFile is an entry of a MemoryRemote along with the parts of a file
+type memoryFile struct {
+	info  types.FileInfo
+	parts []types.FilePart
+}
+
+// MemoryRemote is a Remote keeping folders, files and part contents in
+// memory, so the upload pipeline can run without a server
+type MemoryRemote struct {
+	mu      sync.Mutex
+	nextID  int
+	entries map[string]*memoryFile
+	// pending holds the parts sent for each upload id by part number
+	pending map[string]map[int]types.PartFile
+	// data holds the content of every part sent by part id
+	data map[int][]byte
+}
+
+func NewMemoryRemote() *MemoryRemote {
+	return &MemoryRemote{
+		entries: make(map[string]*memoryFile),
+		pending: make(map[string]map[int]types.PartFile),
+		data:    make(map[int][]byte),
+	}
+}
+
+// newID returns a fresh id. Must be called with the lock held.
+func (m *MemoryRemote) newID() int {
+	m.nextID++
+	return m.nextID
+}
+
+// isDir reports whether dir is a folder. Must be called with the lock held.
+func (m *MemoryRemote) isDir(dir string) bool {
+	if dir == "/" {
+		return true
+	}
+	entry, ok := m.entries[dir]
+	return ok && entry.info.Type == "folder"
+}
+
+// dirID returns the id of the folder dir, the root has none. Must be called
+// with the lock held.
+func (m *MemoryRemote) dirID(dir string) string {
+	if entry, ok := m.entries[dir]; ok {
+		return entry.info.Id
+	}
+	return ""
+}
+
+func (m *MemoryRemote) List(dir string) ([]types.FileInfo, error) {
+	dir = CleanPath(dir)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.isDir(dir) {
+		return nil, fs.ErrorDirNotFound
+	}
+	var files []types.FileInfo
+	for entryPath, entry := range m.entries {
+		if entryPath != "/" && path.Dir(entryPath) == dir {
+			files = append(files, entry.info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files, nil
+}
+
+func (m *MemoryRemote) Find(dir string, name string) (*types.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[path.Join(CleanPath(dir), name)]
+	if !ok {
+		return nil, nil
+	}
+	info := entry.info
+	return &info, nil
+}
+
+func (m *MemoryRemote) Mkdir(dir string) (*types.FileInfo, error) {
+	dir = CleanPath(dir)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if dir == "/" {
+		return nil, nil
+	}
+	current := "/"
+	for _, name := range strings.Split(strings.TrimPrefix(dir, "/"), "/") {
+		parent := current
+		current = path.Join(current, name)
+		entry, ok := m.entries[current]
+		if ok && entry.info.Type != "folder" {
+			return nil, fmt.Errorf("%s is a file", current)
+		}
+		if !ok {
+			m.entries[current] = &memoryFile{info: types.FileInfo{
+				Id:       strconv.Itoa(m.newID()),
+				Name:     name,
+				Type:     "folder",
+				ParentId: m.dirID(parent),
+				ModTime:  time.Now().UTC(),
+			}}
+		}
+	}
+	info := m.entries[dir].info
+	return &info, nil
+}
+
+func (m *MemoryRemote) CreateFile(payload *types.FilePayload) (*types.FileInfo, error) {
+	dir := CleanPath(payload.Path)
+	filePath := path.Join(dir, payload.Name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.isDir(dir) {
+		return nil, fs.ErrorDirNotFound
+	}
+	if _, ok := m.entries[filePath]; ok {
+		return nil, fmt.Errorf("%s already exists", filePath)
+	}
+	var size int64
+	for _, part := range payload.Parts {
+		data, ok := m.data[int(part.ID)]
+		if !ok {
+			return nil, fmt.Errorf("unknown part %d", part.ID)
+		}
+		size += int64(len(data))
+	}
+	if size != payload.Size {
+		return nil, fmt.Errorf("parts hold %d bytes, file has %d", size, payload.Size)
+	}
+
+	modTime := time.Now().UTC()
+	if payload.ModTime != nil {
+		modTime = payload.ModTime.UTC()
+	}
+	entry := &memoryFile{
+		info: types.FileInfo{
+			Id:       strconv.Itoa(m.newID()),
+			Name:     payload.Name,
+			MimeType: payload.MimeType,
+			Size:     payload.Size,
+			ParentId: m.dirID(dir),
+			Type:     "file",
+			ModTime:  modTime,
+			Hash:     payload.Hash,
+		},
+		parts: append([]types.FilePart(nil), payload.Parts...),
+	}
+	m.entries[filePath] = entry
+	info := entry.info
+	return &info, nil
+}
+
+func (m *MemoryRemote) Delete(ids ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range ids {
+		var removed string
+		for entryPath, entry := range m.entries {
+			if entry.info.Id == id {
+				removed = entryPath
+				break
+			}
+		}
+		if removed == "" {
+			return fs.ErrorObjectNotFound
+		}
+		for entryPath := range m.entries {
+			if entryPath == removed || strings.HasPrefix(entryPath, removed+"/") {
+				delete(m.entries, entryPath)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MemoryRemote) SetModTime(info *types.FileInfo, modTime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, entry := range m.entries {
+		if entry.info.Id == info.Id {
+			entry.info.ModTime = modTime.UTC()
+			return nil
+		}
+	}
+	return fs.ErrorObjectNotFound
+}
+
+func (m *MemoryRemote) Rename(info *types.FileInfo, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for entryPath, entry := range m.entries {
+		if entry.info.Id != info.Id {
+			continue
+		}
+		renamed := path.Join(path.Dir(entryPath), name)
+		if _, ok := m.entries[renamed]; ok {
+			return fmt.Errorf("%s already exists", renamed)
+		}
+		for childPath, child := range m.entries {
+			if strings.HasPrefix(childPath, entryPath+"/") {
+				delete(m.entries, childPath)
+				m.entries[renamed+strings.TrimPrefix(childPath, entryPath)] = child
+			}
+		}
+		delete(m.entries, entryPath)
+		entry.info.Name = name
+		m.entries[renamed] = entry
+		return nil
+	}
+	return fs.ErrorObjectNotFound
+}
+
+func (m *MemoryRemote) UploadPart(uploadID string, part PartUpload, body io.Reader) (types.PartFile, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return types.PartFile{}, err
+	}
+	if int64(len(data)) != part.Size {
+		return types.PartFile{}, fmt.Errorf("part %d has %d bytes, expected %d", part.PartNo, len(data), part.Size)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	partFile := types.PartFile{
+		Name:      part.Name,
+		PartId:    m.newID(),
+		PartNo:    part.PartNo,
+		Size:      part.Size,
+		ChannelID: part.ChannelID,
+		Encrypted: part.Encrypted,
+	}
+	m.data[partFile.PartId] = data
+	if m.pending[uploadID] == nil {
+		m.pending[uploadID] = make(map[int]types.PartFile)
+	}
+	m.pending[uploadID][part.PartNo] = partFile
+	return partFile, nil
+}
+
+func (m *MemoryRemote) ListPendingParts(uploadID string) ([]types.PartFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	parts := make([]types.PartFile, 0, len(m.pending[uploadID]))
+	for _, part := range m.pending[uploadID] {
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNo < parts[j].PartNo
+	})
+	return parts, nil
+}
+
+func (m *MemoryRemote) DeletePending(uploadID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.pending, uploadID)
+	return nil
+}
+
+// Content returns the content of the file at remotePath, its parts joined
+// in order
+func (m *MemoryRemote) Content(remotePath string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[CleanPath(remotePath)]
+	if !ok || entry.info.Type != "file" {
+		return nil, fs.ErrorObjectNotFound
+	}
+	parts := append([]types.FilePart(nil), entry.parts...)
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNo < parts[j].PartNo
+	})
+	var content bytes.Buffer
+	for _, part := range parts {
+		content.Write(m.data[int(part.ID)])
+	}
+	return content.Bytes(), nil
+}
@@ -0,0 +1,227 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+	"uploader/pkg/types"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fserrors"
+	"github.com/rclone/rclone/lib/rest"
+	"go.uber.org/zap"
+)
+
+// PartUpload describes a single part sent with Remote.UploadPart
+type PartUpload struct {
+	Name      string
+	FileName  string
+	PartNo    int
+	ChannelID int64
+	Encrypted bool
+	Size      int64
+}
+
+// Remote is the storage the upload pipeline writes to. RESTRemote talks to
+// the Teldrive API, MemoryRemote keeps everything in memory so uploads can
+// be exercised offline.
+type Remote interface {
+	// List returns the contents of the folder dir, or fs.ErrorDirNotFound
+	List(dir string) ([]types.FileInfo, error)
+	// Find returns the file or folder called name in dir, or nil when there
+	// is none
+	Find(dir string, name string) (*types.FileInfo, error)
+	// Mkdir creates the folder dir along with any missing parents. It
+	// returns the folder, or nil when the remote does not tell.
+	Mkdir(dir string) (*types.FileInfo, error)
+	// CreateFile creates a file from parts sent with UploadPart
+	CreateFile(payload *types.FilePayload) (*types.FileInfo, error)
+	// Delete removes the files or folders with the given ids
+	Delete(ids ...string) error
+	// SetModTime sets the modification time of the file or folder info
+	SetModTime(info *types.FileInfo, modTime time.Time) error
+	// Rename changes the name of the file or folder info in its folder
+	Rename(info *types.FileInfo, name string) error
+	// UploadPart sends part of the upload uploadID in a single attempt.
+	// Errors worth another attempt are marked with fserrors.RetryError,
+	// those of a server asking to slow down match ErrThrottled.
+	UploadPart(uploadID string, part PartUpload, body io.Reader) (types.PartFile, error)
+	// ListPendingParts returns the parts of uploadID sent so far
+	ListPendingParts(uploadID string) ([]types.PartFile, error)
+	// DeletePending discards the record of the parts of uploadID, once they
+	// belong to a file
+	DeletePending(uploadID string) error
+}
+
+// ErrThrottled is matched by part upload errors of answers asking the client
+// to slow down, 429 Too Many Requests or a server error
+var ErrThrottled = errors.New("server throttled")
+
+// throttledError keeps the message of an error while matching ErrThrottled
+type throttledError struct {
+	error
+}
+
+func (e throttledError) Unwrap() error {
+	return e.error
+}
+
+func (e throttledError) Is(target error) bool {
+	return target == ErrThrottled
+}
+
+// RESTRemote is the Remote of a Teldrive server
+type RESTRemote struct {
+	http  *rest.Client
+	pacer *fs.Pacer
+	ctx   context.Context
+	files *FileService
+}
+
+func NewRESTRemote(
+	http *rest.Client,
+	pacer *fs.Pacer,
+	ctx context.Context,
+	logger *zap.Logger,
+) *RESTRemote {
+	return &RESTRemote{
+		http:  http,
+		pacer: pacer,
+		ctx:   ctx,
+		files: NewFileService(http, pacer, ctx, logger),
+	}
+}
+
+// WithoutCancel returns a copy of r whose calls are not stopped when the
+// context of r is cancelled
+func (r *RESTRemote) WithoutCancel() Remote {
+	ctx := context.WithoutCancel(r.ctx)
+	files := *r.files
+	files.ctx = ctx
+	return &RESTRemote{
+		http:  r.http,
+		pacer: r.pacer,
+		ctx:   ctx,
+		files: &files,
+	}
+}
+
+// uncancelled returns remote with calls which cancellation does not stop,
+// for remotes whose calls follow a context
+func uncancelled(remote Remote) Remote {
+	if r, ok := remote.(interface{ WithoutCancel() Remote }); ok {
+		return r.WithoutCancel()
+	}
+	return remote
+}
+
+func (r *RESTRemote) List(dir string) ([]types.FileInfo, error) {
+	return r.files.List(dir)
+}
+
+func (r *RESTRemote) Find(dir string, name string) (*types.FileInfo, error) {
+	info, err := r.files.Stat(path.Join(CleanPath(dir), name))
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return nil, nil
+	}
+	return info, err
+}
+
+func (r *RESTRemote) Mkdir(dir string) (*types.FileInfo, error) {
+	return r.files.mkdir(dir)
+}
+
+func (r *RESTRemote) CreateFile(payload *types.FilePayload) (*types.FileInfo, error) {
+	opts := rest.Opts{
+		Method: "POST",
+		Path:   "/api/files",
+	}
+
+	var created types.FileInfo
+	err := r.pacer.Call(func() (bool, error) {
+		resp, err := r.http.CallJSON(r.ctx, &opts, payload, &created)
+		return ShouldRetry(r.ctx, resp, err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+func (r *RESTRemote) Delete(ids ...string) error {
+	return r.files.Delete(ids...)
+}
+
+func (r *RESTRemote) SetModTime(info *types.FileInfo, modTime time.Time) error {
+	return r.files.SetModTime(info, modTime)
+}
+
+func (r *RESTRemote) Rename(info *types.FileInfo, name string) error {
+	return r.files.Rename(info, name)
+}
+
+func (r *RESTRemote) UploadPart(uploadID string, part PartUpload, body io.Reader) (types.PartFile, error) {
+	opts := rest.Opts{
+		Method:        "POST",
+		Path:          "/api/uploads/" + uploadID,
+		Body:          body,
+		ContentLength: &part.Size,
+		ContentType:   "application/octet-stream",
+		Parameters: url.Values{
+			"partName":  []string{part.Name},
+			"fileName":  []string{part.FileName},
+			"partNo":    []string{strconv.Itoa(part.PartNo)},
+			"channelId": []string{strconv.FormatInt(part.ChannelID, 10)},
+			"encrypted": []string{strconv.FormatBool(part.Encrypted)},
+		},
+	}
+
+	var partFile types.PartFile
+	resp, err := r.http.CallJSON(r.ctx, &opts, nil, &partFile)
+	if err != nil {
+		retry, err := ShouldRetry(r.ctx, resp, err)
+		if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError) {
+			err = throttledError{err}
+		}
+		if retry {
+			err = fserrors.RetryError(err)
+		}
+		return partFile, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return partFile, fmt.Errorf("send part failed with status %d", resp.StatusCode)
+	}
+	return partFile, nil
+}
+
+func (r *RESTRemote) ListPendingParts(uploadID string) ([]types.PartFile, error) {
+	opts := rest.Opts{
+		Method: "GET",
+		Path:   "/api/uploads/" + uploadID,
+	}
+
+	var parts []types.PartFile
+	err := r.pacer.Call(func() (bool, error) {
+		resp, err := r.http.CallJSON(r.ctx, &opts, nil, &parts)
+		return ShouldRetry(r.ctx, resp, err)
+	})
+	return parts, err
+}
+
+func (r *RESTRemote) DeletePending(uploadID string) error {
+	opts := rest.Opts{
+		Method: "DELETE",
+		Path:   "/api/uploads/" + uploadID,
+	}
+
+	return r.pacer.Call(func() (bool, error) {
+		resp, err := r.http.CallJSON(r.ctx, &opts, nil, nil)
+		return ShouldRetry(r.ctx, resp, err)
+	})
+}
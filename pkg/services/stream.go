@@ -0,0 +1,271 @@
+package services
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+	"uploader/pkg/checksum"
+	"uploader/pkg/crypt"
+	"uploader/pkg/types"
+
+	"go.uber.org/zap"
+)
+
+// StreamPath stands for the local path of streamed uploads in logs and reports
+const StreamPath = "-"
+
+// spooledPart is a part read from a stream and kept in a temporary file
+// until it is sent
+type spooledPart struct {
+	file *os.File
+	size int64
+}
+
+func (p *spooledPart) remove() {
+	p.file.Close()
+	os.Remove(p.file.Name())
+}
+
+// spoolPart copies up to partSize bytes of r to a temporary file
+func (u *UploadService) spoolPart(r io.Reader, partSize int64) (*spooledPart, error) {
+	file, err := os.CreateTemp("", "uploader-part-*")
+	if err != nil {
+		return nil, err
+	}
+	part := &spooledPart{file: file}
+	part.size, err = io.CopyN(file, r, partSize)
+	if err != nil && err != io.EOF {
+		part.remove()
+		return nil, err
+	}
+	return part, nil
+}
+
+// UploadStream uploads everything read from r as the file name in destDir.
+// The size is not known in advance, so each part is read into a temporary
+// file before it is sent and at most one part per worker is held at once.
+// Streams cannot be resumed, so an existing remote file is an error.
+func (u *UploadService) UploadStream(r io.Reader, name string, destDir string) (err error) {
+	remoteName := u.remoteFileName(name)
+	var nonce crypt.Nonce
+	if u.cipher != nil {
+		nonce, err = crypt.NewNonce()
+		if err != nil {
+			return err
+		}
+		r = u.cipher.EncryptReader(r, nonce)
+	}
+
+	bar := newTransferBar(name, -1)
+	defer bar.Close()
+
+	u.Progress.AddBar(bar)
+
+	u.reporter.FileStarted(StreamPath, path.Join(destDir, remoteName), 0)
+	defer func() {
+		if err != nil {
+			bar.Abort()
+			u.reporter.FileFailed(StreamPath, err)
+		}
+	}()
+
+	existing, err := u.findFile(remoteName, destDir)
+	if err != nil {
+		u.logger.Error("check file exists failed", zap.String("fileName", name), zap.String("destDir", destDir), zap.Error(err))
+		return err
+	}
+
+	// the size of a stream is only known at its end, so it cannot be skipped
+	// or updated depending on the existing file
+	var replace *types.FileInfo
+	if existing != nil {
+		if u.onConflict != ConflictOverwrite && u.onConflict != ConflictRename {
+			return fmt.Errorf("%s already exists", path.Join(destDir, name))
+		}
+		resolved, err := u.resolveConflict(u.onConflict, name, destDir, 0, time.Time{}, existing)
+		if err != nil {
+			return err
+		}
+		remoteName, replace = u.remoteFileName(resolved.name), resolved.replace
+		u.logger.Info("file exists", zap.String("fileName", name), zap.String("resolution", resolved.reason), zap.String("remoteName", remoteName))
+		u.reporter.FileConflict(StreamPath, path.Join(destDir, remoteName), resolved.reason)
+	}
+
+	if u.isDryRun {
+		u.logger.Info("dry run mode enabled, skipping upload", zap.String("fileName", name))
+		u.reporter.FileSkipped(StreamPath, "dry run")
+		return nil
+	}
+
+	// the upload id cannot be derived from the size, any unique id will do
+	uploadID := randomPartName()
+
+	in := bufio.NewReader(r)
+	mimeType := "application/octet-stream"
+	if u.cipher == nil {
+		if head, _ := in.Peek(512); len(head) > 0 {
+			mimeType = http.DetectContentType(head)
+		}
+	}
+
+	// the size is not known, so neither is the part size auto would pick
+	partSize := u.partSizes.Stream()
+
+	var (
+		wg         sync.WaitGroup
+		mu         sync.Mutex
+		parts      []types.FilePart
+		partErr    error
+		uploadSize int64
+		// the number of parts is only known at the end of the input
+		slots = u.parts.File(0)
+	)
+	defer slots.Done()
+	fileHash := checksum.NewFileHash(partSize)
+
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return partErr != nil
+	}
+
+readParts:
+	for partNo := 1; !failed(); partNo++ {
+		// a worker slot is taken before reading so only as many parts as
+		// workers are spooled at once
+		if err := slots.Acquire(u.ctx); err != nil {
+			break readParts
+		}
+
+		part, err := u.spoolPart(in, partSize)
+		if err != nil {
+			slots.Release()
+			mu.Lock()
+			partErr = fmt.Errorf("read input failed: %w", err)
+			mu.Unlock()
+			break
+		}
+		_, peekErr := in.Peek(1)
+		last := peekErr != nil
+		if peekErr != nil && peekErr != io.EOF {
+			slots.Release()
+			part.remove()
+			mu.Lock()
+			partErr = fmt.Errorf("read input failed: %w", peekErr)
+			mu.Unlock()
+			break
+		}
+		if part.size == 0 {
+			// the input ended on a part boundary, or was empty
+			slots.Release()
+			part.remove()
+			break
+		}
+		uploadSize += part.size
+
+		partName := remoteName
+		if u.randomisePart {
+			partName = randomPartName()
+		} else if !last || partNo > 1 {
+			partName = fmt.Sprintf("%s.part.%03d", remoteName, partNo)
+		}
+
+		wg.Add(1)
+		go func(partNo int, part *spooledPart, partName string) {
+			defer wg.Done()
+			defer func() {
+				slots.Release()
+			}()
+			defer part.remove()
+
+			upload := PartUpload{
+				Name:      partName,
+				FileName:  remoteName,
+				PartNo:    partNo,
+				ChannelID: u.channelID,
+				Encrypted: u.encryptFiles,
+				Size:      part.size,
+			}
+			partFile, err := u.sendPart(uploadID, upload, func() io.Reader {
+				return io.NewSectionReader(part.file, 0, part.size)
+			}, bar, StreamPath)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				u.logger.Error("send part file failed", zap.String("fileName", name), zap.Int("partNumber", partNo), zap.Error(err))
+				if partErr == nil {
+					partErr = err
+				}
+				return
+			}
+			parts = append(parts, types.FilePart{ID: int64(partFile.PartId), PartNo: partFile.PartNo, Salt: partFile.Salt, Hash: partFile.Hash})
+			if digest, err := hex.DecodeString(partFile.Hash); err == nil && len(digest) > 0 {
+				fileHash.Add(partFile.PartNo, digest)
+			}
+			u.reporter.PartDone(StreamPath, partFile.PartNo, 0, partFile.Size)
+			u.logger.Debug("part file sent", zap.String("fileName", name), zap.String("partName", partFile.Name), zap.Int("partNumber", partFile.PartNo), zap.Int64("partSize", partFile.Size))
+		}(partNo, part, partName)
+
+		if last {
+			break
+		}
+	}
+
+	wg.Wait()
+
+	if err := u.ctx.Err(); err != nil {
+		return err
+	}
+	if partErr != nil {
+		return partErr
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNo < parts[j].PartNo
+	})
+
+	// a stream has no modification time of its own
+	modTime := time.Now().UTC()
+	filePayload := types.FilePayload{
+		Name:      createName(remoteName, uploadID, replace),
+		Type:      "file",
+		Parts:     parts,
+		MimeType:  mimeType,
+		Path:      destDir,
+		Size:      uploadSize,
+		ChannelID: u.channelID,
+		Encrypted: u.encryptFiles,
+		ModTime:   &modTime,
+	}
+	if len(fileHash.Parts) == len(parts) && u.cipher == nil {
+		filePayload.Hash = fileHash.String()
+	}
+
+	created, err := u.remote.CreateFile(&filePayload)
+	if err != nil {
+		return err
+	}
+
+	if err := u.replaceFile(replace, created, remoteName); err != nil {
+		return err
+	}
+
+	u.deletePending(uploadID, StreamPath)
+
+	// the size is only known now, so it is counted once the stream is done
+	u.Progress.AddTransfer(0, uploadSize)
+	bar.Finish()
+
+	u.logger.Info("file sent", zap.String("fileName", name), zap.Int64("fileSize", uploadSize))
+	u.reporter.FileDone(StreamPath, created.Id)
+
+	return nil
+}
@@ -0,0 +1,372 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+	"uploader/pkg/checksum"
+	"uploader/pkg/types"
+
+	"github.com/rclone/rclone/fs"
+	"go.uber.org/zap"
+)
+
+// modTimeWindow is the precision used when comparing local and remote
+// modification times
+const modTimeWindow = time.Second
+
+type SyncOp string
+
+const (
+	SyncMkdir  SyncOp = "mkdir"
+	SyncUpload SyncOp = "upload"
+	SyncUpdate SyncOp = "update"
+	SyncDelete SyncOp = "delete"
+	SyncTrash  SyncOp = "trash"
+	// SyncConflict is a local entry whose remote counterpart is of another
+	// type and may not be removed, the path is skipped
+	SyncConflict SyncOp = "conflict"
+)
+
+// SyncAction is a single change needed to make the remote match the local tree
+type SyncAction struct {
+	Op         SyncOp
+	LocalPath  string
+	RemotePath string
+	Size       int64
+	Reason     string
+	remote     *types.FileInfo
+	// early removals clear the way for an entry of a different type
+	early bool
+}
+
+func (a SyncAction) String() string {
+	var s string
+	switch a.Op {
+	case SyncMkdir, SyncDelete, SyncTrash:
+		s = fmt.Sprintf("%-6s %s", a.Op, a.RemotePath)
+	default:
+		s = fmt.Sprintf("%-6s %s -> %s", a.Op, a.LocalPath, a.RemotePath)
+	}
+	if a.Reason != "" {
+		s += " (" + a.Reason + ")"
+	}
+	return s
+}
+
+// SyncService mirrors a local tree onto a remote directory, one way
+type SyncService struct {
+	uploader     *UploadService
+	files        *FileService
+	logger       *zap.Logger
+	deleteExtras bool
+	trashDir     string
+	checksum     bool
+}
+
+// NewSyncService returns a SyncService uploading through uploader. Remote
+// files missing locally are deleted when deleteExtras is set, or moved into
+// trashDir when it is not empty. With useChecksum, files of the same size
+// are also compared by content when the remote file has a stored hash.
+func NewSyncService(uploader *UploadService, files *FileService, deleteExtras bool, trashDir string, useChecksum bool) *SyncService {
+	if trashDir != "" {
+		trashDir = CleanPath(trashDir)
+	}
+	return &SyncService{
+		uploader:     uploader,
+		files:        files,
+		logger:       uploader.logger,
+		deleteExtras: deleteExtras,
+		trashDir:     trashDir,
+		checksum:     useChecksum,
+	}
+}
+
+// Plan compares the local tree at sourcePath with the remote directory
+// destDir and returns the actions needed to make them match
+func (s *SyncService) Plan(sourcePath string, destDir string) ([]SyncAction, error) {
+	return s.plan(sourcePath, "", CleanPath(destDir), true)
+}
+
+// plan compares sourcePath, found at rel below the root of the sync, with destDir
+func (s *SyncService) plan(sourcePath string, rel string, destDir string, remoteExists bool) ([]SyncAction, error) {
+	entries, err := os.ReadDir(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteFiles := make(map[string]types.FileInfo)
+	if remoteExists {
+		files, err := s.files.List(destDir)
+		if err != nil && !errors.Is(err, fs.ErrorDirNotFound) {
+			return nil, err
+		}
+		for _, file := range files {
+			name := file.Name
+			if s.uploader.cipher != nil && file.Type != "folder" {
+				name, err = s.uploader.cipher.DecryptFileName(file.Name)
+				if err != nil {
+					s.logger.Warn("skipping remote file which is not encrypted", zap.String("remotePath", path.Join(destDir, file.Name)), zap.Error(err))
+					continue
+				}
+			}
+			remoteFiles[name] = file
+		}
+	}
+
+	var actions []SyncAction
+
+	for _, entry := range entries {
+		fullPath := filepath.Join(sourcePath, entry.Name())
+		entryRel := filepath.Join(rel, entry.Name())
+		remotePath := path.Join(destDir, entry.Name())
+		remote, found := remoteFiles[entry.Name()]
+		// a remote entry is never removed while a local one of the same name exists
+		delete(remoteFiles, entry.Name())
+
+		if entry.IsDir() {
+			if !includeDir(s.uploader.filter, entryRel) {
+				continue
+			}
+			if found && remote.Type != "folder" {
+				if !s.removesExtras() {
+					actions = append(actions, conflictAction(fullPath, remotePath, "remote is a file"))
+					continue
+				}
+				actions = append(actions, s.replaceAction(remotePath, remote, "replaced by a directory"))
+				found = false
+			}
+			if !found {
+				actions = append(actions, SyncAction{Op: SyncMkdir, LocalPath: fullPath, RemotePath: remotePath})
+			}
+			subActions, err := s.plan(fullPath, entryRel, remotePath, found)
+			if err != nil {
+				return nil, err
+			}
+			actions = append(actions, subActions...)
+			continue
+		}
+
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() || !includeFile(s.uploader.filter, entryRel, info) {
+			continue
+		}
+
+		switch {
+		case !found:
+			actions = append(actions, SyncAction{Op: SyncUpload, LocalPath: fullPath, RemotePath: remotePath, Size: info.Size(), Reason: "missing"})
+		case remote.Type == "folder" && !s.removesExtras():
+			actions = append(actions, conflictAction(fullPath, remotePath, "remote is a directory"))
+		case remote.Type == "folder":
+			actions = append(actions, s.replaceAction(remotePath, remote, "replaced by a file"))
+			actions = append(actions, SyncAction{Op: SyncUpload, LocalPath: fullPath, RemotePath: remotePath, Size: info.Size(), Reason: "missing"})
+		default:
+			if reason := s.changedReason(fullPath, info, remote); reason != "" {
+				actions = append(actions, SyncAction{Op: SyncUpdate, LocalPath: fullPath, RemotePath: remotePath, Size: info.Size(), Reason: reason, remote: &remote})
+			}
+		}
+	}
+
+	if s.removesExtras() {
+		names := make([]string, 0, len(remoteFiles))
+		for name := range remoteFiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			remote := remoteFiles[name]
+			remotePath := path.Join(destDir, name)
+			if remotePath == s.trashDir || !s.includeRemote(filepath.Join(rel, name), remote) {
+				continue
+			}
+			actions = append(actions, s.extraAction(remotePath, remote, "not found locally"))
+		}
+	}
+
+	return actions, nil
+}
+
+// includeRemote reports whether the remote entry at rel passes the filter,
+// excluded entries are left alone rather than deleted
+func (s *SyncService) includeRemote(rel string, remote types.FileInfo) bool {
+	fileFilter := s.uploader.filter
+	if fileFilter == nil {
+		return true
+	}
+	if remote.Type == "folder" {
+		return includeDir(fileFilter, rel)
+	}
+	return fileFilter.Include(filepath.ToSlash(rel), remote.Size, remote.ModTime, nil)
+}
+
+// removesExtras reports whether remote entries may be removed, which is
+// only done with -delete or -trash
+func (s *SyncService) removesExtras() bool {
+	return s.deleteExtras || s.trashDir != ""
+}
+
+// conflictAction returns the action skipping a local entry whose remote
+// counterpart has another type and is kept
+func conflictAction(localPath string, remotePath string, reason string) SyncAction {
+	return SyncAction{Op: SyncConflict, LocalPath: localPath, RemotePath: remotePath, Reason: reason + ", use -delete or -trash to replace it"}
+}
+
+// extraAction returns the action removing a remote entry which should not exist
+func (s *SyncService) extraAction(remotePath string, remote types.FileInfo, reason string) SyncAction {
+	op := SyncDelete
+	if s.trashDir != "" {
+		op = SyncTrash
+	}
+	return SyncAction{Op: op, RemotePath: remotePath, Size: remote.Size, Reason: reason, remote: &remote}
+}
+
+// replaceAction returns the action removing a remote entry in the way of a
+// local entry of a different type, which is done before anything is uploaded
+func (s *SyncService) replaceAction(remotePath string, remote types.FileInfo, reason string) SyncAction {
+	action := s.extraAction(remotePath, remote, reason)
+	action.early = true
+	return action
+}
+
+// changedReason returns why the local file differs from remote, or "" when
+// it is up to date
+func (s *SyncService) changedReason(localPath string, local os.FileInfo, remote types.FileInfo) string {
+	localSize := local.Size()
+	if s.uploader.cipher != nil {
+		localSize = s.uploader.cipher.EncryptedSize(localSize)
+	}
+	if localSize != remote.Size {
+		return fmt.Sprintf("size %d != %d", localSize, remote.Size)
+	}
+	if s.checksum && remote.Hash != "" {
+		ok, err := checksum.Verify(localPath, remote.Hash)
+		if err != nil {
+			s.logger.Warn("compare hash failed", zap.String("localPath", localPath), zap.Error(err))
+		} else if !ok {
+			return "hash differs"
+		} else {
+			return ""
+		}
+	}
+	return differsReason(localSize, local.ModTime(), remote)
+}
+
+// Report writes every planned action to w
+func (s *SyncService) Report(w io.Writer, actions []SyncAction) {
+	for _, action := range actions {
+		fmt.Fprintln(w, action.String())
+	}
+}
+
+// Execute applies the planned actions. Directories are created first, then
+// changed and missing files are uploaded, and remote extras are removed
+// once every upload has finished. Failed actions which did not stop the
+// sync are returned as a *TransferError.
+func (s *SyncService) Execute(actions []SyncAction) error {
+	u := s.uploader
+
+	var totalFiles int
+	var totalSize int64
+	for _, action := range actions {
+		if action.Op == SyncUpload || action.Op == SyncUpdate {
+			totalFiles++
+			totalSize += action.Size
+		}
+	}
+	u.Progress.AddTransfer(totalFiles, totalSize)
+
+	var extras []SyncAction
+	for _, action := range actions {
+		if action.Op == SyncConflict {
+			s.logger.Warn("sync", zap.String("action", action.String()))
+			u.reporter.FileConflict(action.LocalPath, action.RemotePath, "skip")
+			u.reporter.FileSkipped(action.LocalPath, action.Reason)
+		}
+		if action.Op == SyncDelete || action.Op == SyncTrash {
+			if action.early {
+				if err := s.removeExtra(action); err != nil {
+					return err
+				}
+			} else {
+				extras = append(extras, action)
+			}
+		}
+	}
+
+	for _, action := range actions {
+		if action.Op != SyncMkdir {
+			continue
+		}
+		s.logger.Info("sync", zap.String("action", action.String()))
+		if err := u.createDirFrom(action.LocalPath, action.RemotePath); err != nil {
+			return err
+		}
+	}
+
+	for _, action := range actions {
+		if action.Op != SyncUpload && action.Op != SyncUpdate {
+			continue
+		}
+		if u.ctx.Err() != nil {
+			break
+		}
+
+		s.logger.Info("sync", zap.String("action", action.String()))
+
+		destDir := path.Dir(action.RemotePath)
+		dirID, err := u.GetDirectoryId(destDir)
+		if err != nil {
+			return err
+		}
+
+		// a changed file is overwritten, which only replaces the remote copy
+		// once the new one was uploaded
+		onConflict := u.onConflict
+		if action.Op == SyncUpdate {
+			onConflict = ConflictOverwrite
+		}
+		u.queueFile(action.LocalPath, destDir, dirID, onConflict, nil)
+	}
+
+	u.Progress.Wait()
+
+	// extras are only removed once the local tree was uploaded completely
+	if err := u.ctx.Err(); err != nil {
+		return err
+	}
+	if err := u.Err(); err != nil {
+		s.logger.Warn("transfers failed, keeping remote extras", zap.Int("extras", len(extras)))
+		return err
+	}
+
+	for _, action := range extras {
+		err := s.removeExtra(action)
+		if err != nil {
+			s.logger.Error("remove remote extra failed", zap.String("remotePath", action.RemotePath), zap.Error(err))
+		}
+		u.results.record(action.RemotePath, err)
+	}
+
+	return u.Err()
+}
+
+// removeExtra deletes the remote entry of action or moves it to the trash directory
+func (s *SyncService) removeExtra(action SyncAction) error {
+	s.logger.Info("sync", zap.String("action", action.String()))
+	if action.Op == SyncTrash {
+		if err := s.files.Mkdir(s.trashDir); err != nil {
+			return err
+		}
+		return s.files.Move(s.trashDir, action.remote.Id)
+	}
+	return s.files.Delete(action.remote.Id)
+}
@@ -5,23 +5,34 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"uploader/pkg/bwlimit"
+	"uploader/pkg/checksum"
+	"uploader/pkg/crypt"
+	"uploader/pkg/dircache"
+	"uploader/pkg/journal"
+	"uploader/pkg/partsize"
 	"uploader/pkg/pb"
+	"uploader/pkg/report"
+	"uploader/pkg/scheduler"
 	"uploader/pkg/types"
 
 	"github.com/gofrs/uuid"
 	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
 	"github.com/rclone/rclone/fs/fserrors"
-	"github.com/rclone/rclone/lib/rest"
+	"github.com/rclone/rclone/lib/pacer"
 	"go.uber.org/zap"
 )
 
@@ -35,154 +46,235 @@ var retryErrorCodes = []int{
 }
 
 type UploadService struct {
-	http              *rest.Client
-	numWorkers        int
+	remote Remote
+	// finish is remote with calls which cancellation does not stop, for
+	// the calls following the creation of a file
+	finish            Remote
+	parts             *scheduler.Scheduler
 	concurrentFiles   chan struct{}
-	partSize          int64
+	partSizes         partsize.Policy
 	encryptFiles      bool
 	randomisePart     bool
 	channelID         int64
 	deleteAfterUpload bool
-	pacer             *fs.Pacer
 	ctx               context.Context
 	Progress          *pb.Progress
 	wg                *sync.WaitGroup
 	logger            *zap.Logger
 	userID            int64
 	isDryRun          bool
+	journal           *journal.Journal
+	filter            *filter.Filter
+	bwLimiter         *bwlimit.Limiter
+	partPacer         *fs.Pacer
+	reporter          *report.Reporter
+	cipher            *crypt.Cipher
+	onConflict        ConflictPolicy
+	dirs              *dircache.Cache
+	tuner             *scheduler.Tuner
+	results           transferResults
+
+	listingsMu sync.Mutex
+	// listings holds the contents of the remote folders listed by
+	// directory uploads, by folder and name
+	listings map[string]map[string]types.FileInfo
 }
 
 func NewUploadService(
-	http *rest.Client,
-	numWorkers int,
+	remote Remote,
+	parts *scheduler.Scheduler,
 	numTransfers int,
-	partSize int64,
+	partSizes partsize.Policy,
 	encryptFiles bool,
 	randomisePart bool,
 	channelID int64,
 	deleteAfterUpload bool,
-	pacer *fs.Pacer,
 	ctx context.Context,
 	progress *pb.Progress,
 	wg *sync.WaitGroup,
 	logger *zap.Logger,
 	userID int64,
 	isDryRun bool,
+	journal *journal.Journal,
+	fileFilter *filter.Filter,
+	bwLimiter *bwlimit.Limiter,
+	partPacer *fs.Pacer,
+	reporter *report.Reporter,
+	cipher *crypt.Cipher,
+	onConflict ConflictPolicy,
+	dirCache *dircache.Cache,
+	tuner *scheduler.Tuner,
 ) *UploadService {
+	if dirCache == nil {
+		dirCache = dircache.New()
+	}
 	return &UploadService{
-		http:              http,
-		numWorkers:        numWorkers,
+		remote:            remote,
+		finish:            uncancelled(remote),
+		parts:             parts,
 		concurrentFiles:   make(chan struct{}, numTransfers),
-		partSize:          partSize,
+		partSizes:         partSizes,
 		encryptFiles:      encryptFiles,
 		randomisePart:     randomisePart,
 		channelID:         channelID,
 		deleteAfterUpload: deleteAfterUpload,
-		pacer:             pacer,
 		ctx:               ctx,
 		wg:                wg,
 		Progress:          progress,
 		logger:            logger,
 		userID:            userID,
 		isDryRun:          isDryRun,
+		journal:           journal,
+		filter:            fileFilter,
+		bwLimiter:         bwLimiter,
+		partPacer:         partPacer,
+		reporter:          reporter,
+		cipher:            cipher,
+		onConflict:        onConflict,
+		dirs:              dirCache,
+		tuner:             tuner,
+		listings:          make(map[string]map[string]types.FileInfo),
 	}
 }
 
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (n int, err error) {
+	n, err = r.Reader.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// newTransferBar returns the progress bar shown for a single file transfer
+func newTransferBar(description string, size int64) *pb.Bar {
+	return pb.NewOptions64(size,
+		pb.OptionShowCount(),
+		pb.OptionEnableColorCodes(true),
+		pb.OptionShowBytes(true),
+		pb.OptionSetWidth(10),
+		pb.OptionSetDescription(description),
+		pb.OptionSetTheme(pb.Theme{
+			Saucer:        "[green]=[reset]",
+			SaucerHead:    "[green]>[reset]",
+			SaucerPadding: " ",
+			BarStart:      "[",
+			BarEnd:        "]",
+		}),
+		pb.OptionFullWidth(),
+		pb.OptionSetRenderBlankState(true))
+}
+
 func ShouldRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
 	if fserrors.ContextError(ctx, &err) {
 		return false, err
 	}
+	if delay := retryAfter(resp); delay > 0 {
+		// the pacer waits as long as the server asked before the next try
+		return true, pacer.RetryAfterError(err, delay)
+	}
 	return fserrors.ShouldRetry(err) || fserrors.ShouldRetryHTTP(resp, retryErrorCodes), err
 }
 
-func (u *UploadService) checkFileExists(fileName string, path string) (bool, error) {
-	u.logger.Debug("checking file exists", zap.String("fileName", fileName), zap.String("path", path))
+// retryAfter returns the wait asked for by the Retry-After header of a 429
+// or 503 response, or 0 when there is none
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return 0
+	}
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
 
-	opts := rest.Opts{
-		Method: "GET",
-		Path:   "/api/files",
-		Parameters: url.Values{
-			"path":      []string{path},
-			"operation": []string{"find"},
-			"name":      []string{fileName},
-		},
+// findFile returns the file or folder named fileName in path, or nil when
+// there is none. Folders listed by listDir are not asked again.
+func (u *UploadService) findFile(fileName string, path string) (*types.FileInfo, error) {
+	if info, ok := u.listed(path, fileName); ok {
+		return info, nil
 	}
 
-	var err error
-	var info types.ReadMetadataResponse
-	var resp *http.Response
+	u.logger.Debug("checking file exists", zap.String("fileName", fileName), zap.String("path", path))
 
-	err = u.pacer.Call(func() (bool, error) {
-		resp, err = u.http.CallJSON(u.ctx, &opts, nil, &info)
-		return ShouldRetry(u.ctx, resp, err)
-	})
-	if err != nil {
-		if u.isDryRun && strings.Contains(err.Error(), "404") {
-			return false, nil
-		}
-		return false, err
-	}
-	if resp != nil && resp.StatusCode != 404 && len(info.Files) > 0 {
-		return true, nil
-	}
+	return u.remote.Find(path, fileName)
+}
 
-	return false, nil
+// remoteFileName returns the name the server sees for the local name
+func (u *UploadService) remoteFileName(name string) string {
+	if u.cipher != nil {
+		return u.cipher.EncryptFileName(name)
+	}
+	return name
 }
 
+// GetDirectoryId returns the id of the remote folder path, which is only
+// looked up the first time
 func (u *UploadService) GetDirectoryId(path string) (string, error) {
+	if id, ok := u.dirs.Get(CleanPath(path)); ok {
+		return id, nil
+	}
+
 	destDirParent := strings.ReplaceAll(filepath.Dir(path), "\\", "/")
 	lastDir := filepath.Base(path)
 
-	opts := rest.Opts{
-		Method: "GET",
-		Path:   "/api/files",
-		Parameters: url.Values{
-			"path":      []string{destDirParent},
-			"name":      []string{lastDir},
-			"operation": []string{"find"},
-			"type":      []string{"folder"},
-		},
-	}
-	var (
-		info types.ReadMetadataResponse
-		resp *http.Response
-		err  error
-	)
-
-	err = u.pacer.Call(func() (bool, error) {
-		resp, err = u.http.CallJSON(u.ctx, &opts, nil, &info)
-		return ShouldRetry(u.ctx, resp, err)
-	})
+	info, err := u.remote.Find(destDirParent, lastDir)
 	if err != nil {
 		u.logger.Error("find parent dir failed", zap.String("destDirParent", destDirParent), zap.String("lastDir", lastDir), zap.Error(err))
 		return "", err
 	}
-	if info.Meta.Count == 0 {
+	if info == nil || info.Type != "folder" {
 		if !u.isDryRun {
 			u.logger.Error("parent dir not found", zap.String("destDirParent", destDirParent), zap.String("lastDir", lastDir))
 			return "", fs.ErrorDirNotFound
 		}
 
-		info.Files = append(info.Files, types.FileInfo{
-			Id: "0",
-		})
+		// the folder of a dry run may not exist, nothing is cached for it
+		return "0", nil
 	}
 
-	return info.Files[0].Id, nil
+	u.dirs.Put(CleanPath(path), info.Id)
+	return info.Id, nil
 }
 
+// UploadFile uploads filePath to destDir, whose id is directoryID. A failure
+// is also counted in Err, as for queued files.
 func (u *UploadService) UploadFile(filePath string, destDir string, directoryID string) error {
+	err := u.uploadFile(filePath, destDir, directoryID, u.onConflict)
+	u.results.record(filePath, err)
+	return err
+}
+
+// uploadFile is UploadFile resolving a taken remote name with onConflict
+func (u *UploadService) uploadFile(filePath string, destDir string, directoryID string, onConflict ConflictPolicy) (err error) {
+	defer func() {
+		if err != nil {
+			u.reporter.FileFailed(filePath, err)
+		}
+	}()
+
 	file, err := os.Open(filePath)
 	if err != nil {
-		u.logger.Fatal("open file failed", zap.String("filePath", filePath), zap.Error(err))
+		u.logger.Error("open file failed", zap.String("filePath", filePath), zap.Error(err))
 		return err
 	}
 	defer file.Close()
 
 	buffer := make([]byte, 512)
 	_, err = file.Read(buffer)
-	if err != nil {
-		u.logger.Fatal("read file failed", zap.String("filePath", filePath), zap.Error(err))
+	// an empty file is uploaded as a file without parts
+	if err != nil && err != io.EOF {
+		u.logger.Error("read file failed", zap.String("filePath", filePath), zap.Error(err))
 		return err
 	}
 
@@ -192,39 +284,59 @@ func (u *UploadService) UploadFile(filePath string, destDir string, directoryID
 	fileSize := fileInfo.Size()
 	fileName := filepath.Base(filePath)
 
-	bar := pb.NewOptions64(fileSize,
-		pb.OptionShowCount(),
-		pb.OptionEnableColorCodes(true),
-		pb.OptionShowBytes(true),
-		pb.OptionSetWidth(10),
-		pb.OptionSetDescription(fileName),
-		pb.OptionSetTheme(pb.Theme{
-			Saucer:        "[green]=[reset]",
-			SaucerHead:    "[green]>[reset]",
-			SaucerPadding: " ",
-			BarStart:      "[",
-			BarEnd:        "]",
-		}),
-		pb.OptionFullWidth(),
-		pb.OptionSetRenderBlankState(true))
+	// with client side encryption the server only sees the encrypted name and content
+	remoteName, uploadSize := u.remoteFileName(fileName), fileSize
+	if u.cipher != nil {
+		uploadSize = u.cipher.EncryptedSize(fileSize)
+		mimeType = "application/octet-stream"
+	}
+
+	bar := newTransferBar(fileName, uploadSize)
 
 	defer bar.Close()
 
 	u.Progress.AddBar(bar)
 
-	exists, err := u.checkFileExists(fileName, destDir)
+	u.reporter.FileStarted(filePath, path.Join(destDir, remoteName), fileSize)
+
+	journalKey := journal.Key(filePath, destDir, fileInfo)
+
+	if u.journal != nil && u.journal.IsCompleted(journalKey) {
+		u.logger.Info("file already uploaded", zap.String("fileName", fileName))
+		u.reporter.FileSkipped(filePath, "already uploaded")
+		return nil
+	}
+
+	existing, err := u.findFile(remoteName, destDir)
 	if err != nil {
 		bar.Abort()
 		u.logger.Error("check file exists failed", zap.String("fileName", fileName), zap.String("destDir", destDir), zap.Error(err))
 		return err
 	}
-	if exists {
-		// u.Progress.AddExisting(fileSize)
-		u.logger.Info("file exists", zap.String("fileName", fileName))
-		return nil
+
+	// replace is the existing entry deleted once the new file is complete
+	var replace *types.FileInfo
+	if existing != nil {
+		resolved, err := u.resolveConflict(onConflict, fileName, destDir, uploadSize, fileInfo.ModTime(), existing)
+		if err != nil {
+			bar.Abort()
+			u.logger.Error("resolve conflict failed", zap.String("fileName", fileName), zap.String("destDir", destDir), zap.Error(err))
+			return err
+		}
+		if resolved.skip != "" {
+			// u.Progress.AddExisting(fileSize)
+			u.logger.Info("file exists", zap.String("fileName", fileName), zap.String("reason", resolved.skip))
+			// nothing was uploaded, so nothing is journaled and another
+			// conflict policy still applies on the next run
+			u.reporter.FileSkipped(filePath, resolved.skip)
+			return nil
+		}
+		remoteName, replace = u.remoteFileName(resolved.name), resolved.replace
+		u.logger.Info("file exists", zap.String("fileName", fileName), zap.String("resolution", resolved.reason), zap.String("remoteName", remoteName))
+		u.reporter.FileConflict(filePath, path.Join(destDir, remoteName), resolved.reason)
 	}
 
-	input := fmt.Sprintf("%s:%s:%d:%d", directoryID, fileName, fileSize, u.userID)
+	input := fmt.Sprintf("%s:%s:%d:%d", directoryID, remoteName, uploadSize, u.userID)
 
 	hash := md5.Sum([]byte(input))
 	hashString := hex.EncodeToString(hash[:])
@@ -232,73 +344,77 @@ func (u *UploadService) UploadFile(filePath string, destDir string, directoryID
 	if u.isDryRun {
 		// u.Progress.AddExisting(fileSize)
 		u.logger.Info("dry run mode enabled, skipping upload", zap.String("fileName", fileName))
+		u.reporter.FileSkipped(filePath, "dry run")
 		return nil
 	}
 
-	uploadURL := fmt.Sprintf("/api/uploads/%s", hashString)
+	uploadID := hashString
 
-	var uploadParts []types.PartFile
-	var existingParts map[int]types.PartFile
-
-	opts := rest.Opts{
-		Method: "GET",
-		Path:   uploadURL,
+	existingParts := make(map[int]types.PartFile)
+	if u.journal != nil {
+		existingParts = u.journal.Parts(journalKey)
 	}
 
-	err = u.pacer.Call(func() (bool, error) {
-		resp, err := u.http.CallJSON(u.ctx, &opts, nil, &uploadParts)
-		return ShouldRetry(u.ctx, resp, err)
-	})
-	if err == nil {
-		existingParts = make(map[int]types.PartFile, len(uploadParts))
-		for _, part := range uploadParts {
-			existingParts[part.PartNo] = part
+	var nonce crypt.Nonce
+	if u.cipher != nil {
+		nonce, existingParts, err = u.uploadNonce(journalKey, filePath, existingParts)
+		if err != nil {
+			bar.Abort()
+			return err
+		}
+	} else if len(existingParts) == 0 {
+		// the server is only asked when the journal knows of no parts
+		var uploadParts []types.PartFile
+		uploadParts, err = u.remote.ListPendingParts(uploadID)
+		if err == nil {
+			for _, part := range uploadParts {
+				existingParts[part.PartNo] = part
+			}
 		}
 	}
 
+	var partSize int64
+	partSize, existingParts = u.uploadPartSize(journalKey, filePath, uploadSize, existingParts)
+
 	var wg sync.WaitGroup
 
-	totalParts := fileSize / u.partSize
-	if fileSize%u.partSize != 0 {
+	totalParts := uploadSize / partSize
+	if uploadSize%partSize != 0 {
 		totalParts++
 	}
 
 	uploadedParts := make(chan types.PartFile, totalParts)
-	concurrentWorkers := make(chan struct{}, u.numWorkers)
+	slots := u.parts.File(int(totalParts))
+	defer slots.Done()
 
 	channelID := u.channelID
 
 	encryptFile := u.encryptFiles
 
-	if len(uploadParts) > 0 {
-		channelID = uploadParts[0].ChannelID
+	for _, part := range existingParts {
+		channelID = part.ChannelID
 
-		encryptFile = uploadParts[0].Encrypted
+		encryptFile = part.Encrypted
+		break
 	}
 
-	go func() {
-		wg.Wait()
-		close(uploadedParts)
-		bar.Finish()
-	}()
-
-	partName := fileName
-
+queueParts:
 	for i := int64(0); i < totalParts; i++ {
-		start := i * u.partSize
-		end := start + u.partSize
-		if end > fileSize {
-			end = fileSize
+		start := i * partSize
+		end := start + partSize
+		if end > uploadSize {
+			end = uploadSize
 		}
 
+		// parts already sent stay on the server, so a cancelled file resumes
+		if err := slots.Acquire(u.ctx); err != nil {
+			break queueParts
+		}
 		wg.Add(1)
-		concurrentWorkers <- struct{}{}
 
 		go func(partNumber int64, start, end int64) {
 			defer wg.Done()
-			defer func() {
-				<-concurrentWorkers
-			}()
+			defer slots.Release()
 
 			file, err := os.Open(filePath)
 			if err != nil {
@@ -307,68 +423,72 @@ func (u *UploadService) UploadFile(filePath string, destDir string, directoryID
 			}
 			defer file.Close()
 			if existing, ok := existingParts[int(partNumber)+1]; ok {
+				if existing.Hash == "" {
+					existing.Hash = u.hashRange(u.partSource(file, fileSize, nonce, start, end), filePath, end-start)
+				}
 				uploadedParts <- existing
 				bar.IncrInt64(existing.Size)
 				return
 			}
 
-			_, err = file.Seek(start, io.SeekStart)
-
-			if err != nil {
-				u.logger.Error("seek file failed", zap.String("filePath", filePath), zap.Error(err))
-				return
-			}
-
-			pr := bar.ProxyReader(file)
-
-			contentLength := end - start
-			reader := io.LimitReader(pr, contentLength)
-
+			partName := remoteName
 			if u.randomisePart {
-				u1, _ := uuid.NewV4()
-				partName = hex.EncodeToString(u1.Bytes())
+				partName = randomPartName()
 			} else if totalParts > 1 {
-				partName = fmt.Sprintf("%s.part.%03d", fileName, partNumber+1)
+				partName = fmt.Sprintf("%s.part.%03d", remoteName, partNumber+1)
 			}
 
-			opts := rest.Opts{
-				Method:        "POST",
-				Path:          uploadURL,
-				Body:          reader,
-				ContentLength: &contentLength,
-				ContentType:   "application/octet-stream",
-				Parameters: url.Values{
-					"partName":  []string{partName},
-					"fileName":  []string{fileName},
-					"partNo":    []string{strconv.FormatInt(partNumber+1, 10)},
-					"channelId": []string{strconv.FormatInt(int64(channelID), 10)},
-					"encrypted": []string{strconv.FormatBool(encryptFile)},
-				},
+			part := PartUpload{
+				Name:      partName,
+				FileName:  remoteName,
+				PartNo:    int(partNumber) + 1,
+				ChannelID: channelID,
+				Encrypted: encryptFile,
+				Size:      end - start,
 			}
-
-			var partFile types.PartFile
-			resp, err := u.http.CallJSON(context.TODO(), &opts, nil, &partFile)
-
+			partFile, err := u.sendPart(uploadID, part, func() io.Reader {
+				return u.partSource(file, fileSize, nonce, start, end)
+			}, bar, filePath)
 			if err != nil {
-				u.logger.Error("send part file failed", zap.String("filePath", filePath), zap.Int64("partNumber", partNumber+1), zap.Int64("totalParts", totalParts), zap.Int64("partSize", contentLength), zap.Error(err))
+				u.logger.Error("send part file failed", zap.String("filePath", filePath), zap.Int64("partNumber", partNumber+1), zap.Int64("totalParts", totalParts), zap.Int64("partSize", end-start), zap.Error(err))
 				return
 			}
-			if resp.StatusCode == 200 {
-				uploadedParts <- partFile
-				u.logger.Debug("part file sent", zap.String("fileName", fileName), zap.String("partName", partFile.Name), zap.Int("partNumber", partFile.PartNo), zap.Int64("totalParts", totalParts), zap.Int64("partSize", partFile.Size), zap.Int("partId", partFile.PartId))
+
+			uploadedParts <- partFile
+			u.reporter.PartDone(filePath, partFile.PartNo, int(totalParts), partFile.Size)
+			if u.journal != nil {
+				if err := u.journal.AddPart(journalKey, filePath, partFile); err != nil {
+					u.logger.Warn("journal part failed", zap.String("filePath", filePath), zap.Error(err))
+				}
 			}
+			u.logger.Debug("part file sent", zap.String("fileName", fileName), zap.String("partName", partFile.Name), zap.Int("partNumber", partFile.PartNo), zap.Int64("totalParts", totalParts), zap.Int64("partSize", partFile.Size), zap.Int("partId", partFile.PartId))
 		}(i, start, end)
 	}
 
+	// only once every part is queued, as the count drops to zero whenever
+	// the parts sent so far finished before the next one got a slot
+	go func() {
+		wg.Wait()
+		close(uploadedParts)
+		bar.Finish()
+	}()
+
 	var parts []types.FilePart
+	fileHash := checksum.NewFileHash(partSize)
 	for uploadPart := range uploadedParts {
 		if uploadPart.PartId != 0 && uploadPart.Size != 0 {
-			parts = append(parts, types.FilePart{ID: int64(uploadPart.PartId), PartNo: uploadPart.PartNo, Salt: uploadPart.Salt})
+			parts = append(parts, types.FilePart{ID: int64(uploadPart.PartId), PartNo: uploadPart.PartNo, Salt: uploadPart.Salt, Hash: uploadPart.Hash})
+			if digest, err := hex.DecodeString(uploadPart.Hash); err == nil && len(digest) > 0 {
+				fileHash.Add(uploadPart.PartNo, digest)
+			}
 		}
 	}
 
 	if len(parts) != int(totalParts) {
 		bar.Abort()
+		if err := u.ctx.Err(); err != nil {
+			return err
+		}
 		u.logger.Error("uploaded parts incomplete", zap.String("fileName", fileName), zap.Int("uploadedParts", len(parts)), zap.Int64("totalParts", totalParts))
 		return fmt.Errorf("uploaded parts incomplete")
 	}
@@ -378,15 +498,23 @@ func (u *UploadService) UploadFile(filePath string, destDir string, directoryID
 		return parts[i].PartNo < parts[j].PartNo
 	})
 
+	modTime := fileInfo.ModTime().UTC()
 	filePayload := types.FilePayload{
-		Name:      fileName,
+		Name:      createName(remoteName, uploadID, replace),
 		Type:      "file",
 		Parts:     parts,
 		MimeType:  mimeType,
 		Path:      destDir,
-		Size:      fileSize,
+		Size:      uploadSize,
 		ChannelID: channelID,
 		Encrypted: encryptFile,
+		ModTime:   &modTime,
+	}
+
+	// the file hash is only meaningful when every part was hashed, and it
+	// cannot be checked against the local file when the content is encrypted
+	if len(fileHash.Parts) == len(parts) && u.cipher == nil {
+		filePayload.Hash = fileHash.String()
 	}
 
 	_, err = json.Marshal(filePayload)
@@ -395,63 +523,223 @@ func (u *UploadService) UploadFile(filePath string, destDir string, directoryID
 		return err
 	}
 
-	opts = rest.Opts{
-		Method: "POST",
-		Path:   "/api/files",
+	created, err := u.remote.CreateFile(&filePayload)
+	if err != nil {
+		return err
+	}
+
+	// the old file is only removed once the new one exists
+	if err := u.replaceFile(replace, created, remoteName); err != nil {
+		return err
+	}
+
+	u.deletePending(uploadID, filePath)
+
+	if u.journal != nil {
+		if err := u.journal.Complete(journalKey, filePath); err != nil {
+			u.logger.Warn("journal file failed", zap.String("filePath", filePath), zap.Error(err))
+		}
 	}
 
-	err = u.pacer.Call(func() (bool, error) {
-		resp, err := u.http.CallJSON(u.ctx, &opts, &filePayload, nil)
-		return ShouldRetry(u.ctx, resp, err)
+	u.updateListing(destDir, remoteName, created)
+
+	u.logger.Info("file sent", zap.String("fileName", fileName), zap.Int64("fileSize", fileSize))
+	u.reporter.FileDone(filePath, created.Id)
+
+	return nil
+}
+
+// deletePending discards the pending parts of uploadID once its file is
+// created. The file is there either way, so a failure is only logged.
+func (u *UploadService) deletePending(uploadID string, filePath string) {
+	if err := u.finish.DeletePending(uploadID); err != nil {
+		u.logger.Warn("delete pending parts failed", zap.String("filePath", filePath), zap.String("uploadID", uploadID), zap.Error(err))
+	}
+}
+
+// randomPartName returns a random name for a part, so part names do not
+// reveal the file they belong to
+func randomPartName() string {
+	u1, _ := uuid.NewV4()
+	return hex.EncodeToString(u1.Bytes())
+}
+
+// sendPart sends part of the upload uploadID and returns it with the hash
+// of the bytes sent. open returns the part content and is called again for
+// every attempt, as each one sends the part from its first byte.
+func (u *UploadService) sendPart(uploadID string, part PartUpload, open func() io.Reader, bar *pb.Bar, filePath string) (types.PartFile, error) {
+	var partFile types.PartFile
+	hasher := checksum.NewPart()
+
+	err := u.partPacer.Call(func() (bool, error) {
+		hasher.Reset()
+
+		sent := &countingReader{Reader: bar.ProxyReader(u.bwLimiter.Reader(u.ctx, open()))}
+
+		var err error
+		partFile, err = u.remote.UploadPart(uploadID, part, io.TeeReader(sent, hasher))
+		if err != nil {
+			// rewind the bar so the retried bytes are not counted twice
+			bar.IncrInt64(-sent.n)
+			if errors.Is(err, ErrThrottled) {
+				u.tuner.Throttled()
+			}
+			retry := u.ctx.Err() == nil && fserrors.IsRetryError(err)
+			if retry {
+				u.logger.Warn("send part file failed, retrying", zap.String("filePath", filePath), zap.Int("partNo", part.PartNo), zap.Error(err))
+			}
+			return retry, err
+		}
+		return false, nil
 	})
+	if err != nil {
+		return partFile, err
+	}
+
+	partFile.Hash = hex.EncodeToString(hasher.Sum(nil))
+	return partFile, nil
+}
 
+// hashRange returns the hex hash of the size bytes of a part uploaded by an
+// earlier run
+func (u *UploadService) hashRange(source io.Reader, filePath string, size int64) string {
+	digest, err := checksum.Range(source, size)
 	if err != nil {
-		return err
+		u.logger.Warn("hash part failed", zap.String("filePath", filePath), zap.Error(err))
+		return ""
+	}
+	return hex.EncodeToString(digest)
+}
+
+// partSource returns the bytes [start, end) of the uploaded form of file,
+// which is encrypted when client side encryption is on
+func (u *UploadService) partSource(file *os.File, fileSize int64, nonce crypt.Nonce, start, end int64) io.Reader {
+	if u.cipher != nil {
+		return u.cipher.EncryptRange(file, fileSize, nonce, start, end-start)
 	}
+	return io.NewSectionReader(file, start, end-start)
+}
 
-	err = u.pacer.Call(func() (bool, error) {
-		resp, err := u.http.CallJSON(u.ctx, &rest.Opts{Method: "DELETE", Path: uploadURL}, nil, nil)
-		return ShouldRetry(u.ctx, resp, err)
-	})
+// uploadNonce returns the nonce filePath is encrypted with. Parts sent by an
+// earlier run are only kept when the journal recorded the nonce they were
+// encrypted with, otherwise a new nonce is drawn and every part is sent again.
+func (u *UploadService) uploadNonce(journalKey string, filePath string, parts map[int]types.PartFile) (crypt.Nonce, map[int]types.PartFile, error) {
+	if u.journal != nil {
+		if nonce, err := crypt.ParseNonce(u.journal.Nonce(journalKey)); err == nil {
+			return nonce, parts, nil
+		}
+	}
 
+	nonce, err := crypt.NewNonce()
 	if err != nil {
-		return err
+		return nonce, nil, err
 	}
+	if u.journal != nil {
+		if err := u.journal.SetNonce(journalKey, filePath, nonce.String()); err != nil {
+			u.logger.Warn("journal nonce failed", zap.String("filePath", filePath), zap.Error(err))
+		}
+	}
+	return nonce, make(map[int]types.PartFile), nil
+}
 
-	u.logger.Info("file sent", zap.String("fileName", fileName), zap.Int64("fileSize", fileSize))
+// uploadPartSize returns the size a file of size bytes is cut in and the
+// parts of an earlier run which can be kept. Parts are resumed at the size
+// the journal recorded for them, so changed part size settings do not mix
+// parts of two sizes, and are sent again when they fit no known size.
+func (u *UploadService) uploadPartSize(journalKey string, filePath string, size int64, parts map[int]types.PartFile) (int64, map[int]types.PartFile) {
+	partSize := u.partSizes.For(size)
+	var recorded int64
+	if u.journal != nil {
+		recorded = u.journal.PartSize(journalKey)
+	}
+
+	if len(parts) > 0 {
+		sizes := make(map[int]int64, len(parts))
+		for partNo, part := range parts {
+			sizes[partNo] = part.Size
+		}
+		switch {
+		case partsize.Fits(sizes, recorded, size):
+			partSize = recorded
+		case partsize.Fits(sizes, partSize, size):
+		default:
+			u.logger.Warn("uploaded parts do not fit the part size, sending them again", zap.String("filePath", filePath), zap.Int64("partSize", partSize))
+			parts = make(map[int]types.PartFile)
+		}
+	}
 
-	return nil
+	if u.journal != nil && recorded != partSize {
+		if err := u.journal.SetPartSize(journalKey, filePath, partSize); err != nil {
+			u.logger.Warn("journal part size failed", zap.String("filePath", filePath), zap.Error(err))
+		}
+	}
+	return partSize, parts
 }
+
 func (u *UploadService) CreateRemoteDir(path string) error {
 	if u.isDryRun {
 		return nil
 	}
 
-	opts := rest.Opts{
-		Method: "POST",
-		Path:   "/api/files/mkdir",
-	}
+	_, err := u.remote.Mkdir(path)
+	return err
+}
 
-	if len(path) == 0 || path[0] != '/' {
-		path = "/" + path
+// createDirFrom creates the remote folder remotePath with the modification
+// time of the local directory localPath. Folders the listing of their
+// parent already holds are not created again.
+func (u *UploadService) createDirFrom(localPath string, remotePath string) error {
+	remotePath = CleanPath(remotePath)
+	parent, name := path.Dir(remotePath), path.Base(remotePath)
+
+	dir, _ := u.listed(parent, name)
+	if dir == nil || dir.Type != "folder" {
+		if u.isDryRun {
+			return nil
+		}
+		created, err := u.remote.Mkdir(remotePath)
+		if err != nil {
+			return err
+		}
+		if created != nil {
+			u.dirs.Put(remotePath, created.Id)
+			u.updateListing(parent, name, created)
+		}
+		dir = created
 	}
-
-	mkdir := types.CreateFileRequest{
-		Path: path,
+	if u.isDryRun {
+		return nil
 	}
 
-	err := u.pacer.Call(func() (bool, error) {
-		resp, err := u.http.CallJSON(u.ctx, &opts, &mkdir, nil)
-		return ShouldRetry(u.ctx, resp, err)
-	})
-
+	info, err := os.Stat(localPath)
 	if err != nil {
-		return err
+		u.logger.Warn("stat local directory failed", zap.String("localPath", localPath), zap.Error(err))
+		return nil
+	}
+	if dir != nil && sameModTime(info.ModTime(), dir.ModTime) {
+		return nil
+	}
+	if dir == nil {
+		// the server did not send the folder back
+		if dir, err = u.remote.Find(parent, name); err != nil || dir == nil {
+			u.logger.Warn("find remote directory failed", zap.String("remotePath", remotePath), zap.Error(err))
+			return nil
+		}
+	}
+	if err := u.remote.SetModTime(dir, info.ModTime()); err != nil {
+		// the folder is there, which is what the files in it need
+		u.logger.Warn("set directory modtime failed", zap.String("localPath", localPath), zap.String("remotePath", remotePath), zap.Error(err))
 	}
 	return nil
 }
 
 func (u *UploadService) UploadFilesInDirectory(sourcePath string, destDir string) error {
+	return u.uploadFilesInDirectory(sourcePath, "", destDir)
+}
+
+// uploadFilesInDirectory uploads sourcePath, found at rel below the root of
+// the transfer, to destDir
+func (u *UploadService) uploadFilesInDirectory(sourcePath string, rel string, destDir string) error {
 	entries, err := os.ReadDir(sourcePath)
 	if err != nil {
 		u.logger.Error("read file failed", zap.String("sourcePath", sourcePath), zap.Error(err))
@@ -460,60 +748,133 @@ func (u *UploadService) UploadFilesInDirectory(sourcePath string, destDir string
 
 	destDir = strings.ReplaceAll(destDir, "\\", "/")
 
+	// one listing tells which files exist and gives the subfolder ids,
+	// instead of a lookup per file
+	if err := u.listDir(destDir); err != nil {
+		u.logger.Error("list remote dir failed", zap.String("destDir", destDir), zap.Error(err))
+		return err
+	}
+
 	for _, entry := range entries {
+		if err := u.ctx.Err(); err != nil {
+			return err
+		}
+
 		fullPath := filepath.Join(sourcePath, entry.Name())
+		entryRel := filepath.Join(rel, entry.Name())
 
 		if entry.IsDir() {
+			if !includeDir(u.filter, entryRel) {
+				u.logger.Debug("excluded dir", zap.String("fullPath", fullPath))
+				continue
+			}
 			subDir := filepath.Join(destDir, entry.Name())
 			subDir = strings.ReplaceAll(subDir, "\\", "/")
-			err := u.CreateRemoteDir(subDir)
+			err := u.createDirFrom(fullPath, subDir)
 			if err != nil {
 				u.logger.Error("create remote dir failed", zap.String("subDir", subDir), zap.Error(err))
+				u.results.record(fullPath, err)
 				continue
 			}
-			err = u.UploadFilesInDirectory(fullPath, subDir)
+			err = u.uploadFilesInDirectory(fullPath, entryRel, subDir)
+			if u.ctx.Err() != nil {
+				return u.ctx.Err()
+			}
 			if err != nil {
 				u.logger.Error("upload files in directory failed", zap.String("fullPath", fullPath), zap.String("subDir", subDir), zap.Error(err))
+				u.results.record(fullPath, err)
 				continue
 			}
 		} else {
+			fileInfo, err := os.Stat(fullPath)
+			if err != nil {
+				u.logger.Error("stat file failed", zap.String("fullPath", fullPath), zap.Error(err))
+				u.results.record(fullPath, err)
+				continue
+			}
+			if !includeFile(u.filter, entryRel, fileInfo) {
+				u.logger.Debug("excluded file", zap.String("fullPath", fullPath))
+				continue
+			}
+
 			dirID, err := u.GetDirectoryId(destDir)
 			if err != nil {
 				u.logger.Error("get directory id failed", zap.String("destDir", destDir), zap.Error(err))
 				return err
 			}
 
-			u.wg.Add(1)
-			u.concurrentFiles <- struct{}{}
+			u.QueueFile(fullPath, destDir, dirID)
+		}
+	}
 
-			go func(file os.DirEntry) {
-				defer u.wg.Done()
-				defer func() {
-					<-u.concurrentFiles
-				}()
+	return nil
+}
 
-				err := u.UploadFile(fullPath, destDir, dirID)
-				if err != nil {
-					u.logger.Error("upload failed", zap.String("fullPath", fullPath), zap.Error(err))
-					return
-				}
+// QueueFile uploads filePath in the background once one of the transfer
+// slots is free. Use Progress.Wait to wait for queued files and Err to learn
+// which of them failed.
+func (u *UploadService) QueueFile(filePath string, destDir string, directoryID string) {
+	u.queueFile(filePath, destDir, directoryID, u.onConflict, nil)
+}
 
-				if u.deleteAfterUpload && !u.isDryRun {
-					err = os.Remove(fullPath)
-					if err != nil {
-						u.logger.Error("delete file failed", zap.String("fullPath", fullPath), zap.Error(err))
-						return
-					}
-					u.logger.Info("deleted file", zap.String("fullPath", fullPath))
-				}
-			}(entry)
+// queueFile is QueueFile resolving a taken remote name with onConflict and
+// calling done, when set, with the upload result. Files still waiting for a
+// slot when the context is cancelled are dropped.
+func (u *UploadService) queueFile(filePath string, destDir string, directoryID string, onConflict ConflictPolicy, done func(error)) {
+	select {
+	case u.concurrentFiles <- struct{}{}:
+	case <-u.ctx.Done():
+		u.results.record(filePath, u.ctx.Err())
+		if done != nil {
+			done(u.ctx.Err())
 		}
+		return
 	}
+	u.wg.Add(1)
 
-	return nil
+	go func() {
+		var err error
+		defer u.wg.Done()
+		defer func() {
+			<-u.concurrentFiles
+			u.results.record(filePath, err)
+			if done != nil {
+				done(err)
+			}
+		}()
+
+		err = u.uploadFile(filePath, destDir, directoryID, onConflict)
+		if errors.Is(err, context.Canceled) {
+			u.logger.Info("upload cancelled", zap.String("fullPath", filePath))
+			return
+		}
+		if err != nil {
+			u.logger.Error("upload failed", zap.String("fullPath", filePath), zap.Error(err))
+			return
+		}
+
+		if u.deleteAfterUpload && !u.isDryRun {
+			err = os.Remove(filePath)
+			if err != nil {
+				u.logger.Error("delete file failed", zap.String("fullPath", filePath), zap.Error(err))
+				return
+			}
+			u.logger.Info("deleted file", zap.String("fullPath", filePath))
+		}
+	}()
+}
+
+// Err returns a *TransferError listing every queued file which failed, or
+// nil when all of them were uploaded. Call it once Progress.Wait returned.
+func (u *UploadService) Err() error {
+	return u.results.err()
 }
 
 func (u *UploadService) GetFilesInDirectoryInfo(sourcePath string) (FileInfo, error) {
+	return u.getFilesInDirectoryInfo(sourcePath, "")
+}
+
+func (u *UploadService) getFilesInDirectoryInfo(sourcePath string, rel string) (FileInfo, error) {
 	entries, err := os.ReadDir(sourcePath)
 	if err != nil {
 		return FileInfo{}, err
@@ -523,9 +884,13 @@ func (u *UploadService) GetFilesInDirectoryInfo(sourcePath string) (FileInfo, er
 
 	for _, entry := range entries {
 		fullPath := filepath.Join(sourcePath, entry.Name())
+		entryRel := filepath.Join(rel, entry.Name())
 
 		if entry.IsDir() {
-			subInfo, err := u.GetFilesInDirectoryInfo(fullPath)
+			if !includeDir(u.filter, entryRel) {
+				continue
+			}
+			subInfo, err := u.getFilesInDirectoryInfo(fullPath, entryRel)
 			if err != nil {
 				return FileInfo{}, err
 			}
@@ -533,11 +898,12 @@ func (u *UploadService) GetFilesInDirectoryInfo(sourcePath string) (FileInfo, er
 			info.TotalFiles += subInfo.TotalFiles
 			info.TotalSize += subInfo.TotalSize
 		} else {
-			info.TotalFiles++
 			fileInfo, err := os.Stat(fullPath)
-			if err == nil {
-				info.TotalSize += fileInfo.Size()
+			if err != nil || !includeFile(u.filter, entryRel, fileInfo) {
+				continue
 			}
+			info.TotalFiles++
+			info.TotalSize += fileInfo.Size()
 		}
 	}
 
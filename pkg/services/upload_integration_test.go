@@ -0,0 +1,805 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"uploader/pkg/crypt"
+	"uploader/pkg/journal"
+	"uploader/pkg/partsize"
+	"uploader/pkg/pb"
+	"uploader/pkg/scheduler"
+	"uploader/pkg/services"
+	"uploader/pkg/teldrivetest"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/pacer"
+	"github.com/rclone/rclone/lib/rest"
+	"go.uber.org/zap"
+)
+
+// testPartSize keeps parts small so a few kilobytes make a multipart upload
+const testPartSize = 1024
+
+// testWorkers is the number of parts sent at once
+const testWorkers = 4
+
+func newTestPacer(ctx context.Context) *fs.Pacer {
+	return fs.NewPacer(ctx, pacer.NewDefault(pacer.MinSleep(time.Millisecond), pacer.MaxSleep(20*time.Millisecond)))
+}
+
+// newUploader returns an UploadService sending to srv, its context is
+// cancelled when the test ends
+func newUploader(t *testing.T, srv *teldrivetest.Server, onConflict services.ConflictPolicy) *services.UploadService {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return newUploaderContext(ctx, srv, testSettings{onConflict: onConflict})
+}
+
+// testSettings are the UploadService settings tests change, unset ones
+// get the test defaults
+type testSettings struct {
+	onConflict services.ConflictPolicy
+	partSizes  partsize.Policy
+	journal    *journal.Journal
+	parts      *scheduler.Scheduler
+	tuner      *scheduler.Tuner
+}
+
+// newUploaderContext is newUploader with a context and settings of its own
+func newUploaderContext(ctx context.Context, srv *teldrivetest.Server, settings testSettings) *services.UploadService {
+	if settings.partSizes == (partsize.Policy{}) {
+		settings.partSizes = partsize.Policy{Fixed: testPartSize}
+	}
+	if settings.parts == nil {
+		settings.parts = scheduler.New(testWorkers)
+	}
+	logger := zap.NewNop()
+	var wg sync.WaitGroup
+	progress := pb.NewProgress(&wg, pb.OptionSetWriter(io.Discard))
+
+	partPacer := newTestPacer(ctx)
+	partPacer.SetMaxConnections(0)
+	partPacer.SetRetries(10)
+
+	remote := services.NewRESTRemote(srv.NewClient(), newTestPacer(ctx), ctx, logger)
+	return services.NewUploadService(remote, settings.parts, 2, settings.partSizes, false, false, 0, false, ctx,
+		progress, &wg, logger, teldrivetest.UserID, false, settings.journal, nil, nil, partPacer, nil, nil, settings.onConflict, nil, settings.tuner)
+}
+
+// writeFile writes size random bytes to name below dir and returns them
+func writeFile(t *testing.T, dir string, name string, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	fullPath := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fullPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// uploadFile uploads localPath to destDir the way the upload command does
+func uploadFile(t *testing.T, uploader *services.UploadService, localPath string, destDir string) error {
+	t.Helper()
+	if err := uploader.CreateRemoteDir(destDir); err != nil {
+		t.Fatalf("create remote dir: %v", err)
+	}
+	dirID, err := uploader.GetDirectoryId(destDir)
+	if err != nil {
+		t.Fatalf("get directory id: %v", err)
+	}
+	uploader.QueueFile(localPath, destDir, dirID)
+	uploader.Progress.Wait()
+	return uploader.Err()
+}
+
+// checkContent fails the test unless remotePath on srv holds want
+func checkContent(t *testing.T, srv *teldrivetest.Server, remotePath string, want []byte) {
+	t.Helper()
+	got, err := srv.Remote.Content(remotePath)
+	if err != nil {
+		t.Fatalf("%s: %v", remotePath, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s: got %d bytes, want %d bytes of other content", remotePath, len(got), len(want))
+	}
+}
+
+// countFaults returns the number of requests the server answered with a fault
+func countFaults(srv *teldrivetest.Server) int {
+	var n int
+	for _, r := range srv.Requests() {
+		if r.Fault != "" {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSession(t *testing.T) {
+	srv := teldrivetest.NewServer()
+	defer srv.Close()
+	ctx := context.Background()
+
+	session, err := services.NewAuthService(srv.NewClient(), newTestPacer(ctx), ctx, zap.NewNop()).Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.UserId != teldrivetest.UserID {
+		t.Fatalf("got user %d, want %d", session.UserId, teldrivetest.UserID)
+	}
+
+	// no session cookie
+	client := rest.NewClient(srv.Client()).SetRoot(srv.URL)
+	_, err = services.NewAuthService(client, newTestPacer(ctx), ctx, zap.NewNop()).Session()
+	if !errors.Is(err, services.ErrSessionRejected) {
+		t.Fatalf("got %v, want %v", err, services.ErrSessionRejected)
+	}
+}
+
+func TestUploadDirectory(t *testing.T) {
+	srv := teldrivetest.NewServer()
+	defer srv.Close()
+
+	local := t.TempDir()
+	files := map[string][]byte{
+		"a.txt":          writeFile(t, local, "a.txt", 100),
+		"big.bin":        writeFile(t, local, "big.bin", 3*testPartSize+17),
+		"sub/b.txt":      writeFile(t, local, "sub/b.txt", 200),
+		"sub/deep/c.txt": writeFile(t, local, "sub/deep/c.txt", testPartSize),
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(local, "a.txt"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	uploader := newUploader(t, srv, services.ConflictSkip)
+	if err := uploader.CreateRemoteDir("/backup"); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploader.UploadFilesInDirectory(local, "/backup"); err != nil {
+		t.Fatal(err)
+	}
+	uploader.Progress.Wait()
+	if err := uploader.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range files {
+		checkContent(t, srv, "/backup/"+name, data)
+	}
+	info, err := srv.Remote.Find("/backup", "a.txt")
+	if err != nil || info == nil {
+		t.Fatalf("find a.txt: %v", err)
+	}
+	if !info.ModTime.Equal(modTime) {
+		t.Fatalf("got modtime %s, want %s", info.ModTime, modTime)
+	}
+	parts, err := srv.Remote.ListPendingParts("")
+	if err != nil || len(parts) != 0 {
+		t.Fatalf("got %d pending parts, %v", len(parts), err)
+	}
+}
+
+func TestUploadMultipart(t *testing.T) {
+	srv := teldrivetest.NewServer()
+	defer srv.Close()
+
+	local := t.TempDir()
+	data := writeFile(t, local, "file.bin", 5*testPartSize+1)
+
+	if err := uploadFile(t, newUploader(t, srv, services.ConflictSkip), filepath.Join(local, "file.bin"), "/"); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, srv, "/file.bin", data)
+	if got := srv.Count("POST", "/api/uploads/"); got != 6 {
+		t.Fatalf("sent %d parts, want 6", got)
+	}
+	if got := srv.Count("DELETE", "/api/uploads/"); got != 1 {
+		t.Fatalf("cleared pending parts %d times, want once", got)
+	}
+}
+
+func TestUploadRetries(t *testing.T) {
+	tests := []struct {
+		name   string
+		faults teldrivetest.Faults
+	}{
+		{"server errors", teldrivetest.Faults{ErrorRate: 0.5, Limit: 8, Seed: 1}},
+		{"dropped connections", teldrivetest.Faults{DropRate: 0.5, Limit: 8, Seed: 2}},
+		{"dropped parts", teldrivetest.Faults{DropRate: 1, Limit: 3, Paths: []string{"/api/uploads/"}}},
+		{"rate limited", teldrivetest.Faults{RateLimitRate: 0.5, Limit: 6, Seed: 3}},
+		{"slow server", teldrivetest.Faults{Latency: 20 * time.Millisecond}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := teldrivetest.NewServer()
+			defer srv.Close()
+			srv.SetFaults(test.faults)
+
+			local := t.TempDir()
+			data := writeFile(t, local, "file.bin", 4*testPartSize+3)
+
+			if err := uploadFile(t, newUploader(t, srv, services.ConflictSkip), filepath.Join(local, "file.bin"), "/dir"); err != nil {
+				t.Fatal(err)
+			}
+			checkContent(t, srv, "/dir/file.bin", data)
+			if test.faults.Limit > 0 && countFaults(srv) == 0 {
+				t.Fatal("no fault was injected")
+			}
+		})
+	}
+}
+
+func TestUploadWaitsForRetryAfter(t *testing.T) {
+	srv := teldrivetest.NewServer()
+	defer srv.Close()
+	srv.SetFaults(teldrivetest.Faults{
+		RateLimitRate: 1,
+		RetryAfter:    time.Second,
+		Paths:         []string{"/api/uploads/"},
+		Limit:         1,
+	})
+
+	local := t.TempDir()
+	data := writeFile(t, local, "file.bin", 100)
+
+	start := time.Now()
+	if err := uploadFile(t, newUploader(t, srv, services.ConflictSkip), filepath.Join(local, "file.bin"), "/"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("retried after %s, server asked for %s", elapsed, time.Second)
+	}
+	checkContent(t, srv, "/file.bin", data)
+}
+
+func TestUploadGivesUp(t *testing.T) {
+	srv := teldrivetest.NewServer()
+	defer srv.Close()
+	srv.SetFaults(teldrivetest.Faults{ErrorRate: 1, Paths: []string{"/api/uploads/"}})
+
+	local := t.TempDir()
+	writeFile(t, local, "file.bin", 100)
+
+	err := uploadFile(t, newUploader(t, srv, services.ConflictSkip), filepath.Join(local, "file.bin"), "/")
+	var transferErr *services.TransferError
+	if !errors.As(err, &transferErr) {
+		t.Fatalf("got %v, want a *TransferError", err)
+	}
+	if info, _ := srv.Remote.Find("/", "file.bin"); info != nil {
+		t.Fatal("file created from failed parts")
+	}
+}
+
+func TestUploadCancelled(t *testing.T) {
+	srv := teldrivetest.NewServer()
+	defer srv.Close()
+	srv.SetFaults(teldrivetest.Faults{Latency: time.Second, Paths: []string{"/api/uploads/"}})
+
+	local := t.TempDir()
+	writeFile(t, local, "file.bin", 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	uploader := newUploaderContext(ctx, srv, testSettings{})
+
+	err := uploadFile(t, uploader, filepath.Join(local, "file.bin"), "/")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestUploadConflicts(t *testing.T) {
+	tests := []struct {
+		policy services.ConflictPolicy
+		// want maps the remote files expected to the local version they hold
+		want map[string]int
+	}{
+		{services.ConflictSkip, map[string]int{"/file.txt": 1}},
+		{services.ConflictOverwrite, map[string]int{"/file.txt": 2}},
+		{services.ConflictRename, map[string]int{"/file.txt": 1, "/file (1).txt": 2}},
+		{services.ConflictUpdate, map[string]int{"/file.txt": 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.policy.String(), func(t *testing.T) {
+			srv := teldrivetest.NewServer()
+			defer srv.Close()
+
+			local := t.TempDir()
+			localPath := filepath.Join(local, "file.txt")
+			versions := map[int][]byte{1: writeFile(t, local, "file.txt", 100)}
+			if err := uploadFile(t, newUploader(t, srv, test.policy), localPath, "/"); err != nil {
+				t.Fatal(err)
+			}
+
+			versions[2] = writeFile(t, local, "file.txt", 150)
+			if err := uploadFile(t, newUploader(t, srv, test.policy), localPath, "/"); err != nil {
+				t.Fatal(err)
+			}
+
+			for remotePath, version := range test.want {
+				checkContent(t, srv, remotePath, versions[version])
+			}
+			files, err := srv.Remote.List("/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != len(test.want) {
+				t.Fatalf("got %d remote files, want %d", len(files), len(test.want))
+			}
+		})
+	}
+}
+
+// autoPartSizes cuts files in three parts of whole MiB
+var autoPartSizes = partsize.Policy{Min: 1, Max: int64(partsize.MaxPart), Target: 3}
+
+func TestUploadAutoPartSize(t *testing.T) {
+	srv := teldrivetest.NewServer()
+	defer srv.Close()
+
+	local := t.TempDir()
+	data := writeFile(t, local, "file.bin", 3*int(fs.Mebi)+5)
+
+	uploader := newUploaderContext(context.Background(), srv, testSettings{partSizes: autoPartSizes})
+	if err := uploadFile(t, uploader, filepath.Join(local, "file.bin"), "/"); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, srv, "/file.bin", data)
+	// a third of the file rounded up to whole MiB gives two parts
+	if got := srv.Count("POST", "/api/uploads/"); got != 2 {
+		t.Fatalf("sent %d parts, want 2", got)
+	}
+}
+
+func TestUploadResumesPartSize(t *testing.T) {
+	tests := []struct {
+		name string
+		// seeded is the part already on the server, cut at seededSize
+		seeded     int
+		seededSize int64
+		// journaledSize, when set, is the part size the journal recorded
+		// along with the seeded part
+		journaledSize int64
+		wantSent      int
+	}{
+		{"same size", 1, 2 * int64(fs.Mebi), 0, 1},
+		{"other size", 2, int64(fs.Mebi), 0, 2},
+		{"journaled size", 2, int64(fs.Mebi), int64(fs.Mebi), 3},
+		{"journaled other size", 2, int64(fs.Mebi), int64(fs.Mebi) / 2, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := teldrivetest.NewServer()
+			defer srv.Close()
+
+			local := t.TempDir()
+			localPath := filepath.Join(local, "file.bin")
+			size := 3*int64(fs.Mebi) + 5
+			data := writeFile(t, local, "file.bin", int(size))
+
+			uploadJournal, err := journal.Open(filepath.Join(t.TempDir(), "uploader.journal"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			uploader := newUploaderContext(context.Background(), srv, testSettings{partSizes: autoPartSizes, journal: uploadJournal})
+
+			// the upload id the uploader derives for the file
+			dirID, err := uploader.GetDirectoryId("/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum := md5.Sum([]byte(fmt.Sprintf("%s:%s:%d:%d", dirID, "file.bin", size, teldrivetest.UserID)))
+			start := int64(test.seeded-1) * test.seededSize
+			part, err := srv.Remote.UploadPart(hex.EncodeToString(sum[:]), services.PartUpload{
+				Name:   "seeded",
+				PartNo: test.seeded,
+				Size:   test.seededSize,
+			}, bytes.NewReader(data[start:start+test.seededSize]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.journaledSize > 0 {
+				info, err := os.Stat(localPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				key := journal.Key(localPath, "/", info)
+				if err := uploadJournal.SetPartSize(key, localPath, test.journaledSize); err != nil {
+					t.Fatal(err)
+				}
+				if err := uploadJournal.AddPart(key, localPath, part); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := uploadFile(t, uploader, localPath, "/"); err != nil {
+				t.Fatal(err)
+			}
+			checkContent(t, srv, "/file.bin", data)
+			if got := srv.Count("POST", "/api/uploads/"); got != test.wantSent {
+				t.Fatalf("sent %d parts, want %d", got, test.wantSent)
+			}
+			// parts the journal knows of are resumed without asking the server
+			if got := srv.Count("GET", "/api/uploads/"); test.journaledSize > 0 && got != 0 {
+				t.Fatalf("listed pending parts %d times, want none", got)
+			}
+		})
+	}
+}
+
+func TestUploadCapsPartsInFlight(t *testing.T) {
+	srv := teldrivetest.NewServer()
+	defer srv.Close()
+	// slow parts pile up unless the cap holds them back
+	srv.SetFaults(teldrivetest.Faults{Latency: 20 * time.Millisecond, Paths: []string{"/api/uploads/"}})
+
+	local := t.TempDir()
+	files := make(map[string][]byte)
+	for i := 1; i <= 4; i++ {
+		name := fmt.Sprintf("file%d.bin", i)
+		files[name] = writeFile(t, local, name, 6*testPartSize+i)
+	}
+
+	// two files at once with four parts each would be eight in flight
+	uploader := newUploader(t, srv, services.ConflictSkip)
+	if err := uploader.UploadFilesInDirectory(local, "/"); err != nil {
+		t.Fatal(err)
+	}
+	uploader.Progress.Wait()
+	if err := uploader.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range files {
+		checkContent(t, srv, "/"+name, data)
+	}
+	if got := srv.MaxPartsInFlight(); got > testWorkers {
+		t.Fatalf("%d parts in flight, want at most %d", got, testWorkers)
+	}
+}
+
+func TestUploadBacksOffWhenThrottled(t *testing.T) {
+	srv := teldrivetest.NewServer()
+	defer srv.Close()
+	srv.SetFaults(teldrivetest.Faults{RateLimitRate: 1, Methods: []string{"POST"}, Paths: []string{"/api/uploads/"}, Limit: 2})
+
+	local := t.TempDir()
+	data := writeFile(t, local, "file.bin", 4*testPartSize)
+
+	parts := scheduler.New(8)
+	tuner := scheduler.NewTuner(parts, 2, 16, func() float64 { return 0 }, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	uploader := newUploaderContext(ctx, srv, testSettings{parts: parts, tuner: tuner})
+
+	if err := uploadFile(t, uploader, filepath.Join(local, "file.bin"), "/"); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, srv, "/file.bin", data)
+	// both 429s arrive within one interval, which halves the limit once
+	if got := parts.Limit(); got != 4 {
+		t.Fatalf("limit is %d after throttling, want 4", got)
+	}
+}
+
+// syncTree uploads local to /sync, deleting remote extras, and returns the
+// error of the sync
+func syncTree(t *testing.T, srv *teldrivetest.Server, local string, deleteExtras bool) error {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	uploader := newUploaderContext(ctx, srv, testSettings{})
+	files := services.NewFileService(srv.NewClient(), newTestPacer(ctx), ctx, zap.NewNop())
+	syncer := services.NewSyncService(uploader, files, deleteExtras, "", false)
+
+	actions, err := syncer.Plan(local, "/sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return syncer.Execute(actions)
+}
+
+func TestStatCrypt(t *testing.T) {
+	srv := teldrivetest.NewServer()
+	defer srv.Close()
+
+	cipher, err := crypt.New("potato", "sausage", crypt.NameEncryptionStandard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := t.TempDir()
+	remoteName := cipher.EncryptFileName("file.txt")
+	writeFile(t, local, remoteName, 100)
+	if err := uploadFile(t, newUploader(t, srv, services.ConflictSkip), filepath.Join(local, remoteName), "/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	files := services.NewFileService(srv.NewClient(), newTestPacer(ctx), ctx, zap.NewNop())
+	for _, remotePath := range []string{"/dir/file.txt", "/dir/" + remoteName} {
+		info, err := files.StatCrypt(remotePath, cipher)
+		if err != nil || info.Name != remoteName {
+			t.Fatalf("StatCrypt(%s) = %v, %v, want %s", remotePath, info, err, remoteName)
+		}
+	}
+	if _, err := files.StatCrypt("/dir/file.txt", nil); !errors.Is(err, fs.ErrorObjectNotFound) {
+		t.Fatalf("got %v without a cipher, want %v", err, fs.ErrorObjectNotFound)
+	}
+}
+
+func TestSyncKeepsRemoteOnFailure(t *testing.T) {
+	srv := teldrivetest.NewServer()
+	defer srv.Close()
+
+	local := t.TempDir()
+	old := writeFile(t, local, "changed.txt", 100)
+	extra := writeFile(t, local, "extra.txt", 50)
+	if _, err := srv.Remote.Mkdir("/sync"); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncTree(t, srv, local, true); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, local, "changed.txt", 150)
+	if err := os.Remove(filepath.Join(local, "extra.txt")); err != nil {
+		t.Fatal(err)
+	}
+	srv.SetFaults(teldrivetest.Faults{ErrorRate: 1, Paths: []string{"/api/uploads/"}})
+
+	var transferErr *services.TransferError
+	if err := syncTree(t, srv, local, true); !errors.As(err, &transferErr) {
+		t.Fatalf("got %v, want a *TransferError", err)
+	}
+	// neither the changed file nor the extra is removed by a failed sync
+	checkContent(t, srv, "/sync/changed.txt", old)
+	checkContent(t, srv, "/sync/extra.txt", extra)
+
+	srv.SetFaults(teldrivetest.Faults{})
+	if err := syncTree(t, srv, local, true); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, srv, "/sync/changed.txt", writeFile(t, local, "changed.txt", 150))
+	if info, _ := srv.Remote.Find("/sync", "extra.txt"); info != nil {
+		t.Fatal("extra not removed by a complete sync")
+	}
+}
+
+func TestSyncKeepsOtherTypes(t *testing.T) {
+	srv := teldrivetest.NewServer()
+	defer srv.Close()
+
+	local := t.TempDir()
+	writeFile(t, local, "dir/file.txt", 100)
+	data := writeFile(t, local, "file.txt", 50)
+	if _, err := srv.Remote.Mkdir("/sync/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	other := t.TempDir()
+	remoteFile := writeFile(t, other, "dir", 20)
+	if err := uploadFile(t, newUploader(t, srv, services.ConflictSkip), filepath.Join(other, "dir"), "/sync"); err != nil {
+		t.Fatal(err)
+	}
+
+	// without -delete entries of another type are skipped, not removed
+	if err := syncTree(t, srv, local, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Count("POST", "/api/files/delete"); got != 0 {
+		t.Fatalf("sent %d deletes, want none without -delete", got)
+	}
+	checkContent(t, srv, "/sync/dir", remoteFile)
+	if info, _ := srv.Remote.Find("/sync", "file.txt"); info == nil || info.Type != "folder" {
+		t.Fatal("remote directory replaced without -delete")
+	}
+
+	if err := syncTree(t, srv, local, true); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, srv, "/sync/file.txt", data)
+	checkContent(t, srv, "/sync/dir/file.txt", writeFile(t, local, "dir/file.txt", 100))
+}
+
+func TestWatch(t *testing.T) {
+	srv := teldrivetest.NewServer()
+	defer srv.Close()
+
+	local := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	uploader := newUploaderContext(ctx, srv, testSettings{})
+	if err := uploader.CreateRemoteDir("/watch"); err != nil {
+		t.Fatal(err)
+	}
+
+	watched := make(chan error, 1)
+	go func() {
+		watched <- services.NewWatchService(uploader, 10*time.Millisecond).Watch(local, "/watch")
+	}()
+	// give the watcher time to watch the directory
+	time.Sleep(100 * time.Millisecond)
+
+	writeFile(t, local, "empty.txt", 0)
+	writeFile(t, local, "gone.txt", 100)
+	if err := os.Remove(filepath.Join(local, "gone.txt")); err != nil {
+		t.Fatal(err)
+	}
+	data := writeFile(t, local, "file.txt", 100)
+
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		empty, _ := srv.Remote.Find("/watch", "empty.txt")
+		file, _ := srv.Remote.Find("/watch", "file.txt")
+		if empty != nil && file != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("settled files not uploaded")
+		}
+	}
+	// the uploads may still be finishing when the watch is cancelled
+	cancel()
+	if err := <-watched; !errors.Is(err, context.Canceled) {
+		t.Fatalf("watch returned %v, want %v", err, context.Canceled)
+	}
+	uploader.Progress.Wait()
+
+	checkContent(t, srv, "/watch/empty.txt", nil)
+	checkContent(t, srv, "/watch/file.txt", data)
+	if info, _ := srv.Remote.Find("/watch", "gone.txt"); info != nil {
+		t.Fatal("removed file uploaded")
+	}
+	if parts, err := srv.Remote.ListPendingParts(""); err != nil || len(parts) != 0 {
+		t.Fatalf("got %d pending parts, %v", len(parts), err)
+	}
+	if err := uploader.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file removed once it was queued fails alone instead of ending the run
+	dirID, err := uploader.GetDirectoryId("/watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uploader.UploadFile(filepath.Join(local, "gone.txt"), "/watch", dirID); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("got %v, want %v", err, os.ErrNotExist)
+	}
+	var transferErr *services.TransferError
+	if err := uploader.Err(); !errors.As(err, &transferErr) || !transferErr.Partial() {
+		t.Fatalf("got %v, want a partial *TransferError", err)
+	}
+}
+
+func TestOverwriteKeepsFileWhenCreateFails(t *testing.T) {
+	srv := teldrivetest.NewServer()
+	defer srv.Close()
+
+	local := t.TempDir()
+	localPath := filepath.Join(local, "file.txt")
+	old := writeFile(t, local, "file.txt", 100)
+	uploader := newUploader(t, srv, services.ConflictOverwrite)
+	if err := uploadFile(t, uploader, localPath, "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, local, "file.txt", 150)
+	dirID, err := uploader.GetDirectoryId("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SetFaults(teldrivetest.Faults{ErrorRate: 1, Methods: []string{"POST"}, Paths: []string{"/api/files"}})
+	uploader = newUploader(t, srv, services.ConflictOverwrite)
+	if err := uploader.UploadFile(localPath, "/", dirID); err == nil {
+		t.Fatal("overwrite succeeded without creating the file")
+	}
+
+	checkContent(t, srv, "/file.txt", old)
+	if got := srv.Count("POST", "/api/files/delete"); got != 0 {
+		t.Fatalf("sent %d deletes, want none before the new file exists", got)
+	}
+	files, err := srv.Remote.List("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got %d remote files, want only the old one", len(files))
+	}
+}
+
+func TestOverwriteFinishesAfterCancel(t *testing.T) {
+	srv := teldrivetest.NewServer()
+	defer srv.Close()
+
+	local := t.TempDir()
+	localPath := filepath.Join(local, "file.txt")
+	writeFile(t, local, "file.txt", 100)
+	if err := uploadFile(t, newUploader(t, srv, services.ConflictOverwrite), localPath, "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	data := writeFile(t, local, "file.txt", 150)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	uploader := newUploaderContext(ctx, srv, testSettings{onConflict: services.ConflictOverwrite})
+	dirID, err := uploader.GetDirectoryId("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the old file is deleted slowly, the run is cancelled meanwhile
+	srv.SetFaults(teldrivetest.Faults{Latency: 300 * time.Millisecond, Methods: []string{"POST"}, Paths: []string{"/api/files/delete"}})
+	uploaded := make(chan error, 1)
+	go func() {
+		uploaded <- uploader.UploadFile(localPath, "/", dirID)
+	}()
+	for deadline := time.Now().Add(10 * time.Second); srv.Count("POST", "/api/files/delete") == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("replaced file not deleted")
+		}
+	}
+	cancel()
+
+	// the file exists once it is created, so replacing and clean up finish
+	if err := <-uploaded; err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, srv, "/file.txt", data)
+	files, err := srv.Remote.List("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got %d remote files, want only the new one", len(files))
+	}
+	parts, err := srv.Remote.ListPendingParts("")
+	if err != nil || len(parts) != 0 {
+		t.Fatalf("got %d pending parts, %v", len(parts), err)
+	}
+}
+
+func TestSkipNotJournaled(t *testing.T) {
+	srv := teldrivetest.NewServer()
+	defer srv.Close()
+
+	local := t.TempDir()
+	localPath := filepath.Join(local, "file.txt")
+	old := writeFile(t, local, "file.txt", 100)
+	if err := uploadFile(t, newUploader(t, srv, services.ConflictSkip), localPath, "/"); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, srv, "/file.txt", old)
+
+	uploadJournal, err := journal.Open(filepath.Join(t.TempDir(), "uploader.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uploadJournal.Close()
+	data := writeFile(t, local, "file.txt", 150)
+	settings := testSettings{journal: uploadJournal, onConflict: services.ConflictSkip}
+	if err := uploadFile(t, newUploaderContext(context.Background(), srv, settings), localPath, "/"); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, srv, "/file.txt", old)
+
+	// the skipped file is not taken for uploaded by a run overwriting it
+	settings.onConflict = services.ConflictOverwrite
+	if err := uploadFile(t, newUploaderContext(context.Background(), srv, settings), localPath, "/"); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, srv, "/file.txt", data)
+}
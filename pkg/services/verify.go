@@ -0,0 +1,141 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"uploader/pkg/checksum"
+	"uploader/pkg/crypt"
+	"uploader/pkg/types"
+
+	"github.com/rclone/rclone/fs"
+	"go.uber.org/zap"
+)
+
+type VerifyStatus string
+
+const (
+	VerifyOK       VerifyStatus = "ok"
+	VerifyMismatch VerifyStatus = "mismatch"
+	VerifySize     VerifyStatus = "size-differs"
+	VerifyMissing  VerifyStatus = "missing"
+	VerifyNoHash   VerifyStatus = "no-hash"
+	VerifyError    VerifyStatus = "error"
+)
+
+// VerifyResult is the outcome of checking a single local file
+type VerifyResult struct {
+	LocalPath  string
+	RemotePath string
+	Status     VerifyStatus
+	Err        error
+}
+
+// Failed reports whether the local and remote files are known to differ
+func (r VerifyResult) Failed() bool {
+	return r.Status != VerifyOK && r.Status != VerifyNoHash
+}
+
+// VerifyService checks local trees against the hashes stored with remote files
+type VerifyService struct {
+	files  *FileService
+	logger *zap.Logger
+	cipher *crypt.Cipher
+}
+
+// NewVerifyService returns a VerifyService. When cipher is set remote files
+// are looked up by their encrypted names, which carry no hash.
+func NewVerifyService(files *FileService, logger *zap.Logger, cipher *crypt.Cipher) *VerifyService {
+	return &VerifyService{
+		files:  files,
+		logger: logger,
+		cipher: cipher,
+	}
+}
+
+// RemoteName returns the name the local file name has on the remote
+func (v *VerifyService) RemoteName(name string) string {
+	if v.cipher == nil {
+		return name
+	}
+	return v.cipher.EncryptFileName(name)
+}
+
+// VerifyFile compares the local file at localPath with remote
+func (v *VerifyService) VerifyFile(localPath string, remotePath string, remote types.FileInfo) VerifyResult {
+	result := VerifyResult{LocalPath: localPath, RemotePath: remotePath}
+
+	info, err := os.Stat(localPath)
+	if err != nil {
+		result.Status, result.Err = VerifyError, err
+		return result
+	}
+
+	localSize := info.Size()
+	if v.cipher != nil {
+		localSize = v.cipher.EncryptedSize(localSize)
+	}
+
+	switch {
+	case localSize != remote.Size:
+		result.Status = VerifySize
+	case remote.Hash == "":
+		result.Status = VerifyNoHash
+	default:
+		ok, err := checksum.Verify(localPath, remote.Hash)
+		switch {
+		case err != nil:
+			result.Status, result.Err = VerifyError, err
+		case ok:
+			result.Status = VerifyOK
+		default:
+			result.Status = VerifyMismatch
+		}
+	}
+
+	v.logger.Debug("verified file", zap.String("localPath", localPath), zap.String("status", string(result.Status)))
+
+	return result
+}
+
+// VerifyDirectory checks every file below sourcePath against destDir and
+// passes each result to report
+func (v *VerifyService) VerifyDirectory(sourcePath string, destDir string, report func(VerifyResult)) error {
+	entries, err := os.ReadDir(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	remoteFiles := make(map[string]types.FileInfo)
+	files, err := v.files.List(destDir)
+	if err != nil && !errors.Is(err, fs.ErrorDirNotFound) {
+		return err
+	}
+	for _, file := range files {
+		remoteFiles[file.Name] = file
+	}
+
+	for _, entry := range entries {
+		fullPath := filepath.Join(sourcePath, entry.Name())
+
+		if entry.IsDir() {
+			remotePath := path.Join(destDir, entry.Name())
+			if err := v.VerifyDirectory(fullPath, remotePath, report); err != nil {
+				return err
+			}
+			continue
+		}
+
+		remotePath := path.Join(destDir, v.RemoteName(entry.Name()))
+		remote, found := remoteFiles[path.Base(remotePath)]
+		if !found || remote.Type == "folder" {
+			report(VerifyResult{LocalPath: fullPath, RemotePath: remotePath, Status: VerifyMissing})
+			continue
+		}
+
+		report(v.VerifyFile(fullPath, remotePath, remote))
+	}
+
+	return nil
+}
@@ -0,0 +1,232 @@
+package services
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// pendingFile is a file seen in the watched tree which may still be written to
+type pendingFile struct {
+	size        int64
+	modTime     time.Time
+	stableSince time.Time
+}
+
+// WatchService uploads files dropped into a local directory once they stop growing
+type WatchService struct {
+	uploader   *UploadService
+	logger     *zap.Logger
+	settle     time.Duration
+	sourcePath string
+	destDir    string
+
+	mu       sync.Mutex
+	pending  map[string]*pendingFile
+	inFlight map[string]bool
+	dirIDs   map[string]string
+}
+
+// NewWatchService returns a WatchService uploading through uploader. A file
+// is uploaded once its size and modification time have not changed for settle.
+func NewWatchService(uploader *UploadService, settle time.Duration) *WatchService {
+	return &WatchService{
+		uploader: uploader,
+		logger:   uploader.logger,
+		settle:   settle,
+		pending:  make(map[string]*pendingFile),
+		inFlight: make(map[string]bool),
+		dirIDs:   make(map[string]string),
+	}
+}
+
+// Watch uploads files below sourcePath to destDir as they appear and only
+// returns when the watcher fails or the uploader's context is cancelled.
+// Files already present are queued too, so a restarted watch picks up
+// whatever was missed while it was down.
+func (w *WatchService) Watch(sourcePath string, destDir string) error {
+	w.sourcePath = sourcePath
+	w.destDir = CleanPath(destDir)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := w.addTree(watcher, sourcePath); err != nil {
+		return err
+	}
+
+	w.logger.Info("watching for new files", zap.String("sourcePath", sourcePath), zap.String("destDir", w.destDir), zap.Duration("settle", w.settle))
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			w.handleEvent(watcher, event)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			w.logger.Error("watch failed", zap.Error(err))
+		case <-ticker.C:
+			w.uploadSettled()
+		case <-w.uploader.ctx.Done():
+			return w.uploader.ctx.Err()
+		}
+	}
+}
+
+// addTree watches root and every directory below it and marks the files
+// found as pending
+func (w *WatchService) addTree(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(fullPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if rel, err := filepath.Rel(w.sourcePath, fullPath); err == nil && rel != "." && !includeDir(w.uploader.filter, rel) {
+				return filepath.SkipDir
+			}
+			return watcher.Add(fullPath)
+		}
+		if entry.Type().IsRegular() {
+			w.markPending(fullPath)
+		}
+		return nil
+	})
+}
+
+func (w *WatchService) handleEvent(watcher *fsnotify.Watcher, event fsnotify.Event) {
+	switch {
+	case event.Has(fsnotify.Create) || event.Has(fsnotify.Write):
+		info, err := os.Stat(event.Name)
+		if err != nil {
+			return
+		}
+		if info.IsDir() {
+			if err := w.addTree(watcher, event.Name); err != nil {
+				w.logger.Error("watch dir failed", zap.String("path", event.Name), zap.Error(err))
+			}
+			return
+		}
+		if info.Mode().IsRegular() {
+			w.markPending(event.Name)
+		}
+	case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+		w.mu.Lock()
+		delete(w.pending, event.Name)
+		w.mu.Unlock()
+	}
+}
+
+func (w *WatchService) markPending(fullPath string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.inFlight[fullPath] {
+		return
+	}
+	if _, ok := w.pending[fullPath]; !ok {
+		w.pending[fullPath] = &pendingFile{size: -1}
+	}
+}
+
+// uploadSettled queues every pending file which stopped changing
+func (w *WatchService) uploadSettled() {
+	now := time.Now()
+
+	w.mu.Lock()
+	var settled []string
+	for fullPath, p := range w.pending {
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			delete(w.pending, fullPath)
+			continue
+		}
+		if info.Size() != p.size || !info.ModTime().Equal(p.modTime) {
+			p.size, p.modTime, p.stableSince = info.Size(), info.ModTime(), now
+			continue
+		}
+		if now.Sub(p.stableSince) >= w.settle {
+			delete(w.pending, fullPath)
+			// size and age rules only make sense once the file stopped growing
+			if rel, err := filepath.Rel(w.sourcePath, fullPath); err == nil && !includeFile(w.uploader.filter, rel, info) {
+				w.logger.Debug("excluded file", zap.String("fullPath", fullPath))
+				continue
+			}
+			w.inFlight[fullPath] = true
+			settled = append(settled, fullPath)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, fullPath := range settled {
+		w.upload(fullPath)
+	}
+}
+
+func (w *WatchService) upload(fullPath string) {
+	done := func(error) {
+		w.mu.Lock()
+		delete(w.inFlight, fullPath)
+		w.mu.Unlock()
+	}
+
+	destDir := w.destDir
+	if rel, err := filepath.Rel(w.sourcePath, filepath.Dir(fullPath)); err == nil && rel != "." {
+		destDir = path.Join(w.destDir, filepath.ToSlash(rel))
+	}
+
+	dirID, err := w.directoryID(destDir)
+	if err != nil {
+		w.logger.Error("get directory id failed", zap.String("destDir", destDir), zap.Error(err))
+		done(err)
+		return
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		done(err)
+		return
+	}
+
+	w.logger.Info("file settled", zap.String("fullPath", fullPath), zap.Int64("size", info.Size()))
+	w.uploader.Progress.AddTransfer(1, info.Size())
+
+	// queueing blocks while every transfer slot is busy. The file is counted
+	// before it is handed over, so waiting for the uploads never starts
+	// while one is still on its way to the queue.
+	w.uploader.wg.Add(1)
+	go func() {
+		defer w.uploader.wg.Done()
+		w.uploader.queueFile(fullPath, destDir, dirID, w.uploader.onConflict, done)
+	}()
+}
+
+// directoryID returns the id of destDir, creating it on first use
+func (w *WatchService) directoryID(destDir string) (string, error) {
+	if dirID, ok := w.dirIDs[destDir]; ok {
+		return dirID, nil
+	}
+	if err := w.uploader.CreateRemoteDir(destDir); err != nil {
+		return "", err
+	}
+	dirID, err := w.uploader.GetDirectoryId(destDir)
+	if err != nil {
+		return "", err
+	}
+	w.dirIDs[destDir] = dirID
+	return dirID, nil
+}
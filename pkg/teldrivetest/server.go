@@ -0,0 +1,440 @@
+// Package teldrivetest runs a fake Teldrive server for tests. It keeps its
+// files in a services.MemoryRemote and can be told to misbehave.
+package teldrivetest
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"uploader/pkg/services"
+	"uploader/pkg/types"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/rest"
+)
+
+// Token is the session token the server accepts
+const Token = "teldrivetest-token"
+
+// UserID is the id of the user of the session
+const UserID int64 = 42
+
+// Faults makes the server misbehave on a share of the requests. Rates are
+// between 0 and 1 and drawn for every request, in the order listed.
+type Faults struct {
+	// DropRate closes the connection without an answer
+	DropRate float64
+	// RateLimitRate answers 429 Too Many Requests with a Retry-After header
+	// of RetryAfter, rounded up to whole seconds
+	RateLimitRate float64
+	RetryAfter    time.Duration
+	// ErrorRate answers 500 Internal Server Error
+	ErrorRate float64
+	// Latency delays every answer, faulty or not
+	Latency time.Duration
+	// Paths limits the faults and latency to requests whose path starts
+	// with one of them, every request is affected when empty
+	Paths []string
+	// Methods limits the faults and latency to requests of these methods,
+	// every method is affected when empty
+	Methods []string
+	// Limit is how many faults are injected at most, 0 for no limit
+	Limit int
+	// Seed makes the choice of faulty requests repeatable
+	Seed int64
+}
+
+// Request is a request the server received
+type Request struct {
+	Method string
+	Path   string
+	// Fault is the fault injected, "" when the request was served
+	Fault string
+}
+
+// Server is a fake Teldrive API backed by a MemoryRemote
+type Server struct {
+	*httptest.Server
+	Remote *services.MemoryRemote
+
+	mu       sync.Mutex
+	faults   Faults
+	rand     *rand.Rand
+	injected int
+	requests []Request
+	// parts and maxParts count the part uploads being received
+	parts    int
+	maxParts int
+}
+
+// NewServer starts a server, which must be closed with Close
+func NewServer() *Server {
+	s := &Server{
+		Remote: services.NewMemoryRemote(),
+		rand:   rand.New(rand.NewSource(1)),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// SetFaults replaces the faults injected from now on
+func (s *Server) SetFaults(faults Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = faults
+	s.rand = rand.New(rand.NewSource(faults.Seed))
+	s.injected = 0
+}
+
+// Requests returns every request received so far
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Count returns how many requests with method, or any method when empty,
+// had a path starting with prefix
+func (s *Server) Count(method string, prefix string) int {
+	var n int
+	for _, r := range s.Requests() {
+		if (method == "" || r.Method == method) && strings.HasPrefix(r.Path, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// MaxPartsInFlight returns the most part uploads received at once
+func (s *Server) MaxPartsInFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxParts
+}
+
+// NewClient returns a REST client for the server, signed in as UserID
+func (s *Server) NewClient() *rest.Client {
+	return rest.NewClient(s.Client()).SetRoot(s.URL).SetCookie(&http.Cookie{
+		Name:  services.SessionCookie,
+		Value: Token,
+	})
+}
+
+// fault picks the fault of a method request to path, "" for none
+func (s *Server) fault(method string, path string) (fault string, latency time.Duration, retryAfter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.faults
+	if len(f.Methods) > 0 {
+		matched := false
+		for _, m := range f.Methods {
+			if m == method {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return "", 0, 0
+		}
+	}
+	if len(f.Paths) > 0 {
+		matched := false
+		for _, prefix := range f.Paths {
+			if strings.HasPrefix(path, prefix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return "", 0, 0
+		}
+	}
+	latency = f.Latency
+	if f.Limit > 0 && s.injected >= f.Limit {
+		return "", latency, 0
+	}
+
+	switch {
+	case f.DropRate > 0 && s.rand.Float64() < f.DropRate:
+		fault = "drop"
+	case f.RateLimitRate > 0 && s.rand.Float64() < f.RateLimitRate:
+		fault = "429"
+	case f.ErrorRate > 0 && s.rand.Float64() < f.ErrorRate:
+		fault = "500"
+	}
+	if fault != "" {
+		s.injected++
+	}
+	return fault, latency, f.RetryAfter
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	fault, latency, retryAfter := s.fault(r.Method, r.URL.Path)
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Fault: fault})
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	switch fault {
+	case "drop":
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		// without a connection to drop the closest is an empty answer
+		panic(http.ErrAbortHandler)
+	case "429":
+		seconds := int((retryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		writeError(w, http.StatusTooManyRequests, "too many requests")
+		return
+	case "500":
+		writeError(w, http.StatusInternalServerError, "injected failure")
+		return
+	}
+
+	if cookie, err := r.Cookie(services.SessionCookie); err != nil || cookie.Value != Token {
+		writeError(w, http.StatusUnauthorized, "invalid session")
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/api/auth/session" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, types.Session{
+			UserName: "teldrivetest",
+			UserId:   UserID,
+			Expires:  time.Now().Add(30 * 24 * time.Hour).UTC(),
+		})
+	case r.URL.Path == "/api/files" && r.Method == http.MethodGet:
+		s.getFiles(w, r)
+	case r.URL.Path == "/api/files" && r.Method == http.MethodPost:
+		s.createFile(w, r)
+	case r.URL.Path == "/api/files/mkdir" && r.Method == http.MethodPost:
+		s.mkdir(w, r)
+	case r.URL.Path == "/api/files/delete" && r.Method == http.MethodPost:
+		s.deleteFiles(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/files/") && r.Method == http.MethodPatch:
+		s.updateFile(w, r, strings.TrimPrefix(r.URL.Path, "/api/files/"))
+	case strings.HasPrefix(r.URL.Path, "/api/uploads/"):
+		s.uploads(w, r, strings.TrimPrefix(r.URL.Path, "/api/uploads/"))
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{"code": status, "message": message})
+}
+
+// writeRemoteError answers with the status matching an error of the remote
+func writeRemoteError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, fs.ErrorDirNotFound), errors.Is(err, fs.ErrorObjectNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case strings.Contains(err.Error(), "already exists"):
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusBadRequest, err.Error())
+	}
+}
+
+// getFiles answers the find and list operations
+func (s *Server) getFiles(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	dir := services.CleanPath(query.Get("path"))
+
+	if query.Get("operation") == "find" {
+		var files []types.FileInfo
+		info, err := s.Remote.Find(dir, query.Get("name"))
+		if err != nil {
+			writeRemoteError(w, err)
+			return
+		}
+		if info != nil && (query.Get("type") == "" || query.Get("type") == info.Type) {
+			files = append(files, *info)
+		}
+		writeJSON(w, http.StatusOK, types.ReadMetadataResponse{Files: files, Meta: types.Meta{Count: len(files), TotalPages: 1, CurrentPage: 1}})
+		return
+	}
+
+	files, err := s.Remote.List(dir)
+	if err != nil {
+		writeRemoteError(w, err)
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+
+	page, _ := strconv.Atoi(query.Get("page"))
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = len(files) + 1
+	}
+	totalPages := (len(files) + limit - 1) / limit
+	if totalPages == 0 {
+		totalPages = 1
+	}
+	start := (page - 1) * limit
+	if start > len(files) {
+		start = len(files)
+	}
+	end := start + limit
+	if end > len(files) {
+		end = len(files)
+	}
+	writeJSON(w, http.StatusOK, types.ReadMetadataResponse{
+		Files: files[start:end],
+		Meta:  types.Meta{Count: len(files), TotalPages: totalPages, CurrentPage: page},
+	})
+}
+
+func (s *Server) createFile(w http.ResponseWriter, r *http.Request) {
+	var payload types.FilePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if payload.Type == "folder" {
+		info, err := s.Remote.Mkdir(path.Join(services.CleanPath(payload.Path), payload.Name))
+		if err != nil {
+			writeRemoteError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, info)
+		return
+	}
+	info, err := s.Remote.CreateFile(&payload)
+	if err != nil {
+		writeRemoteError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func (s *Server) mkdir(w http.ResponseWriter, r *http.Request) {
+	var request types.CreateFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	info, err := s.Remote.Mkdir(request.Path)
+	if err != nil {
+		writeRemoteError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func (s *Server) deleteFiles(w http.ResponseWriter, r *http.Request) {
+	var request types.DeleteFilesRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.Remote.Delete(request.Files...); err != nil {
+		writeRemoteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// updateFile renames the file id or sets its modification time
+func (s *Server) updateFile(w http.ResponseWriter, r *http.Request, id string) {
+	var request types.UpdateFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if request.Name != "" {
+		if err := s.Remote.Rename(&types.FileInfo{Id: id}, request.Name); err != nil {
+			writeRemoteError(w, err)
+			return
+		}
+	}
+	if request.ModTime != nil {
+		if err := s.Remote.SetModTime(&types.FileInfo{Id: id}, *request.ModTime); err != nil {
+			writeRemoteError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) uploads(w http.ResponseWriter, r *http.Request, uploadID string) {
+	switch r.Method {
+	case http.MethodGet:
+		parts, err := s.Remote.ListPendingParts(uploadID)
+		if err != nil {
+			writeRemoteError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, parts)
+	case http.MethodPost:
+		s.mu.Lock()
+		s.parts++
+		if s.parts > s.maxParts {
+			s.maxParts = s.parts
+		}
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			s.parts--
+			s.mu.Unlock()
+		}()
+
+		query := r.URL.Query()
+		partNo, _ := strconv.Atoi(query.Get("partNo"))
+		channelID, _ := strconv.ParseInt(query.Get("channelId"), 10, 64)
+		part := services.PartUpload{
+			Name:      query.Get("partName"),
+			FileName:  query.Get("fileName"),
+			PartNo:    partNo,
+			ChannelID: channelID,
+			Encrypted: query.Get("encrypted") == "true",
+			Size:      r.ContentLength,
+		}
+		partFile, err := s.Remote.UploadPart(uploadID, part, r.Body)
+		if err != nil {
+			writeRemoteError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, partFile)
+	case http.MethodDelete:
+		if err := s.Remote.DeletePending(uploadID); err != nil {
+			writeRemoteError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
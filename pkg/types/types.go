@@ -1,6 +1,9 @@
 package types
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type PartFile struct {
 	Name       string `json:"name"`
@@ -11,12 +14,14 @@ type PartFile struct {
 	ChannelID  int64  `json:"channelId"`
 	Encrypted  bool   `json:"encrypted"`
 	Salt       string `json:"salt"`
+	Hash       string `json:"hash,omitempty"`
 }
 
 type FilePart struct {
 	ID     int64  `json:"id"`
 	PartNo int    `json:"partNo"`
 	Salt   string `json:"salt"`
+	Hash   string `json:"hash,omitempty"`
 }
 
 type FilePayload struct {
@@ -28,6 +33,8 @@ type FilePayload struct {
 	Size      int64      `json:"size"`
 	ChannelID int64      `json:"channelId"`
 	Encrypted bool       `json:"encrypted"`
+	Hash      string     `json:"hash,omitempty"`
+	ModTime   *time.Time `json:"updatedAt,omitempty"`
 }
 
 type CreateFileRequest struct {
@@ -40,7 +47,7 @@ type CreateFileRequest struct {
 	Encrypted bool       `json:"encrypted,omitempty"`
 	Parts     []FilePart `json:"parts,omitempty"`
 	ParentId  string     `json:"parentId,omitempty"`
-	ModTime   time.Time  `json:"updatedAt,omitempty"`
+	ModTime   *time.Time `json:"updatedAt,omitempty"`
 }
 
 // MetadataRequestOptions represents all the options when listing folder contents
@@ -58,6 +65,7 @@ type FileInfo struct {
 	ParentId string    `json:"parentId"`
 	Type     string    `json:"type"`
 	ModTime  time.Time `json:"updatedAt"`
+	Hash     string    `json:"hash,omitempty"`
 }
 
 type Meta struct {
@@ -73,7 +81,50 @@ type ReadMetadataResponse struct {
 }
 
 type Session struct {
-	UserName string `json:"userName"`
-	UserId   int64  `json:"userId"`
-	Hash     string `json:"hash"`
+	UserName string    `json:"userName"`
+	UserId   int64     `json:"userId"`
+	Hash     string    `json:"hash"`
+	Expires  time.Time `json:"expires"`
+}
+
+// LoginMessage is sent over the login websocket to drive Telegram's sign in
+type LoginMessage struct {
+	AuthType      string `json:"authType"`
+	Message       string `json:"message,omitempty"`
+	PhoneNo       string `json:"phoneNo,omitempty"`
+	PhoneCodeHash string `json:"phoneCodeHash,omitempty"`
+	PhoneCode     string `json:"phoneCode,omitempty"`
+	Password      string `json:"password,omitempty"`
+}
+
+// LoginEvent is received over the login websocket. The payload of a
+// successful sign in is the Telegram session posted to /api/auth/login.
+type LoginEvent struct {
+	Type    string          `json:"type"`
+	Message string          `json:"message"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// DeleteFilesRequest is the request body when deleting files or folders
+type DeleteFilesRequest struct {
+	Files []string `json:"files"`
+}
+
+// MoveFilesRequest is the request body when moving files or folders
+type MoveFilesRequest struct {
+	Files       []string `json:"files"`
+	Destination string   `json:"destination"`
+}
+
+// CopyFileRequest is the request body when copying a file on the server
+type CopyFileRequest struct {
+	NewName     string `json:"newName"`
+	Destination string `json:"destination"`
+}
+
+// UpdateFileRequest is the request body when renaming a file or folder
+type UpdateFileRequest struct {
+	Name    string     `json:"name,omitempty"`
+	Type    string     `json:"type,omitempty"`
+	ModTime *time.Time `json:"updatedAt,omitempty"`
 }
@@ -0,0 +1,29 @@
+package types
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnsetModTimeOmitted(t *testing.T) {
+	for _, body := range []interface{}{FilePayload{Name: "file"}, CreateFileRequest{Path: "/dir"}} {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(b), "updatedAt") {
+			t.Fatalf("unset modtime sent: %s", b)
+		}
+	}
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	b, err := json.Marshal(FilePayload{Name: "file", ModTime: &modTime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"updatedAt":"2020-01-02T03:04:05Z"`) {
+		t.Fatalf("modtime missing: %s", b)
+	}
+}